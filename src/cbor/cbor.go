@@ -0,0 +1,240 @@
+// Package cbor -- decoder for CBOR, RFC 7049, a binary peer of the json lexer.
+// Like msgpack, it produces the same tokens the json lexer would for the
+// equivalent json: map keys become BEGIN names and each array element
+// repeats its array's name. Byte strings are base64-encoded into VALUEs.
+package cbor
+
+import (
+	"token"
+	"trace"
+	"lexer"
+
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Magic is the self-describe tag, 55799, that may start a cbor file
+const Magic = "\xd9\xd9\xf7"
+
+// decoder decodes cbor by its headers, and its breaks
+var decoder = lexer.Decoder{Header: header, Break: "\xff"}
+
+// Lex is the entry point to the cbor decoder
+func Lex(input string, tp trace.Trace) []token.Token {
+	return LexContext(context.Background(), input, tp)
+}
+
+// LexContext decodes until done or until ctx is cancelled, when the
+// tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) []token.Token {
+	defer tp.Begin()()
+	return lexer.Lex(ctx, input, decoder.Decode, tp)
+}
+
+// Valid reports whether input is exactly one cbor value, for use in
+// guessing the type of binary input
+func Valid(input string) bool {
+	return decoder.Valid(input)
+}
+
+// atBreak looks for the break that ends an indefinite string, without
+// advancing
+func atBreak(l *lexer.Lexer) bool {
+	return l.HasPrefix("\xff")
+}
+
+// header decodes the initial byte and its argument, up to the contents
+// of a map or array
+func header(l *lexer.Lexer) (lexer.Item, error) {
+	b, ok := l.Take(1)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("unexpected end of input")
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	if major == 7 {
+		return simple(l, info)
+	}
+	if info == 31 {
+		switch major {
+		case 2, 3:
+			return chunks(l, major)
+		case 4:
+			return lexer.Item{Kind: lexer.Array, N: lexer.Indefinite}, nil
+		case 5:
+			return lexer.Item{Kind: lexer.Mapping, N: lexer.Indefinite}, nil
+		}
+		return lexer.Item{}, fmt.Errorf("indefinite length for major type %d", major)
+	}
+
+	u, err := argument(l, info)
+	if err != nil {
+		return lexer.Item{}, err
+	}
+	switch major {
+	case 0:
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatUint(u, 10)}, nil
+	case 1:
+		// -1 - u, which may not fit in an int64
+		n := new(big.Int).SetUint64(u)
+		return lexer.Item{Kind: lexer.Scalar, Text: n.Neg(n.Add(n, big.NewInt(1))).String()}, nil
+	case 2:
+		s, err := take(l, u)
+		return lexer.Item{Kind: lexer.Scalar, Text: base64.StdEncoding.EncodeToString([]byte(s))}, err
+	case 3:
+		s, err := take(l, u)
+		return lexer.Item{Kind: lexer.Scalar, Text: s}, err
+	case 4, 5:
+		if u > uint64(l.Buffered()) {
+			return lexer.Item{}, fmt.Errorf("count %d is longer than the input", u)
+		}
+		if major == 4 {
+			return lexer.Item{Kind: lexer.Array, N: int(u)}, nil
+		}
+		return lexer.Item{Kind: lexer.Mapping, N: int(u)}, nil
+	}
+	return tag(l, u)
+}
+
+// tag decodes a tagged item. Bignums, tags 2 and 3, become decimal
+// numbers; other tags, such as dates, are transparent.
+func tag(l *lexer.Lexer, u uint64) (lexer.Item, error) {
+	if u != 2 && u != 3 {
+		return header(l)
+	}
+	b, ok := l.Take(1)
+	if !ok || b[0]>>5 != 2 {
+		return lexer.Item{}, fmt.Errorf("bignum is not a byte string")
+	}
+	size, err := argument(l, b[0]&0x1f)
+	if err != nil {
+		return lexer.Item{}, err
+	}
+	s, err := take(l, size)
+	if err != nil {
+		return lexer.Item{}, err
+	}
+	n := new(big.Int).SetBytes([]byte(s))
+	if u == 3 {
+		n.Neg(n.Add(n, big.NewInt(1)))
+	}
+	return lexer.Item{Kind: lexer.Scalar, Text: n.String()}, nil
+}
+
+// chunks concatenates the definite-length chunks of an indefinite
+// byte or text string, up to the break
+func chunks(l *lexer.Lexer, major byte) (lexer.Item, error) {
+	var s string
+
+	for !atBreak(l) {
+		b, ok := l.Take(1)
+		if !ok || b[0]>>5 != major || b[0]&0x1f == 31 {
+			return lexer.Item{}, fmt.Errorf("bad chunk in an indefinite string")
+		}
+		size, err := argument(l, b[0]&0x1f)
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		chunk, err := take(l, size)
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		s += chunk
+	}
+	l.Take(1) // the break
+	if major == 2 {
+		s = base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return lexer.Item{Kind: lexer.Scalar, Text: s}, nil
+}
+
+// simple decodes major type 7: booleans, null, undefined and floats
+func simple(l *lexer.Lexer, info byte) (lexer.Item, error) {
+	switch info {
+	case 20:
+		return lexer.Item{Kind: lexer.Scalar, Text: "false"}, nil
+	case 21:
+		return lexer.Item{Kind: lexer.Scalar, Text: "true"}, nil
+	case 22:
+		return lexer.Item{Kind: lexer.Scalar, Text: "null"}, nil
+	case 23:
+		return lexer.Item{Kind: lexer.Scalar, Text: "undefined"}, nil
+	case 24:
+		u, err := argument(l, info)
+		return lexer.Item{Kind: lexer.Scalar, Text: fmt.Sprintf("simple(%d)", u)}, err
+	case 25:
+		u, err := argument(l, info)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatFloat(half(uint16(u)), 'g', -1, 32)}, err
+	case 26:
+		u, err := argument(l, info)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatFloat(
+			float64(math.Float32frombits(uint32(u))), 'g', -1, 32)}, err
+	case 27:
+		u, err := argument(l, info)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatFloat(
+			math.Float64frombits(u), 'g', -1, 64)}, err
+	case 31:
+		return lexer.Item{}, fmt.Errorf("unexpected break")
+	}
+	if info < 20 {
+		return lexer.Item{Kind: lexer.Scalar, Text: fmt.Sprintf("simple(%d)", info)}, nil
+	}
+	return lexer.Item{}, fmt.Errorf("invalid simple value %d", info)
+}
+
+// half converts an IEEE 754 half-precision float
+func half(h uint16) float64 {
+	var f float64
+
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// argument decodes the number that follows an initial byte: small values
+// are in the byte itself, larger ones in the next 1, 2, 4 or 8 bytes
+func argument(l *lexer.Lexer, info byte) (uint64, error) {
+	var u uint64
+
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, fmt.Errorf("invalid additional information %d", info)
+	}
+	size := 1 << (info - 24)
+	s, ok := l.Take(size)
+	if !ok {
+		return 0, fmt.Errorf("unexpected end of input")
+	}
+	for i := 0; i < size; i++ {
+		u = u<<8 | uint64(s[i])
+	}
+	return u, nil
+}
+
+// take takes a string of n bytes
+func take(l *lexer.Lexer, n uint64) (string, error) {
+	if n > uint64(l.Buffered()) {
+		return "", fmt.Errorf("string of %d bytes is longer than the input", n)
+	}
+	s, _ := l.Take(int(n))
+	return s, nil
+}
@@ -0,0 +1,184 @@
+package format
+
+import (
+	"cbor"
+	"fragment"
+	"har"
+	json_lexer "json"
+	"msgpack"
+	"plist"
+	"soap"
+	"token"
+	"trace"
+	"unpack"
+	xml_lexer "xml"
+	"xmlrpc"
+
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// members is the option of the archive formats that picks which of
+// their members are read
+var members = Option{Name: "members", Usage: "read only the zip or tar `members` matching a glob"}
+
+// The built-in formats. Archives are detected first, by their magic
+// numbers, then binary formats, as text detection is only a matter of
+// looking for telling strings, then the specific kinds of xml before
+// plain xml, and json last. Csv is only read when it's asked for.
+func init() {
+	builtin(Format{Name: "zip", Usage: "read a zip archive, querying each member by its type", Priority: 1,
+		Detect: func(s string) bool { return unpack.Type(s) == "zip" },
+		Options: []Option{members},
+		Unpack: archive})
+	builtin(Format{Name: "tar", Usage: "read a tar archive, querying each member by its type", Priority: 2,
+		Detect: func(s string) bool { return unpack.Type(s) == "tar" },
+		Options: []Option{members},
+		Unpack: archive})
+	builtin(Format{Name: "msgpack", Usage: "parse MessagePack input", Priority: 20,
+		Detect: func(s string) bool {
+			return isBinary(s) && !strings.HasPrefix(s, cbor.Magic) && msgpack.Valid(s)
+		},
+		Lex: single(msgpack.LexContext)})
+	builtin(Format{Name: "cbor", Usage: "parse CBOR input", Priority: 21,
+		Detect: func(s string) bool {
+			return isBinary(s) && (strings.HasPrefix(s, cbor.Magic) || cbor.Valid(s))
+		},
+		Lex: single(cbor.LexContext)})
+	builtin(Format{Name: "har", Usage: "parse a HAR archive, querying each response", Priority: 30,
+		Detect: func(s string) bool { return !isBinary(s) && har.IsHAR(s) },
+		Lex: harDocuments})
+	builtin(Format{Name: "soap", Usage: "parse a SOAP envelope, querying its body and reporting faults", Priority: 40,
+		Detect: func(s string) bool { return isXML(s) && soap.IsSoap(s) },
+		Lex: soapDocuments})
+	builtin(Format{Name: "xmlrpc", Usage: "parse XML-RPC input, naming struct members", Priority: 41,
+		Detect: func(s string) bool {
+			return isXML(s) && (strings.Contains(s, "<methodResponse") || strings.Contains(s, "<methodCall"))
+		},
+		Lex: single(xmlrpc.LexContext)})
+	builtin(Format{Name: "plist", Usage: "parse an Apple property list, naming dict keys", Priority: 42,
+		Detect: func(s string) bool { return isXML(s) && strings.Contains(s, "<plist") },
+		Lex: single(plist.LexContext)})
+	builtin(Format{Name: "xml", Usage: "parse xml input", Priority: 49,
+		Detect: isXML,
+		Lex: single(xml_lexer.LexContext),
+		Start: xml_lexer.Start})
+	builtin(Format{Name: "json", Usage: "parse json input", Priority: 50,
+		Detect: func(s string) bool {
+			return !isBinary(s) && (strings.Contains(s, ":") || strings.Contains(s, "{"))
+		},
+		Lex: single(json_lexer.LexContext),
+		Start: json_lexer.Start})
+	builtin(Format{Name: "csv", Usage: "parse csv input", Priority: 60,
+		Lex: func(context.Context, string, Options, trace.Trace) ([]Document, error) {
+			return nil, fmt.Errorf("sorry, csv isn't implemented yet")
+		}})
+	builtin(Format{Name: "logs", Usage: "parse json embedded in lines of text, such as logs", Priority: 90,
+		Options: []Option{{Name: "logxml", Usage: "with -logs, parse embedded xml as well", Bool: true}},
+		Lex: logDocuments})
+}
+
+// builtin registers a built-in format, whose name can't be taken yet
+func builtin(f Format) {
+	if err := Register(f); err != nil {
+		panic(err)
+	}
+}
+
+// archive returns the members of a zip or tar archive that -members
+// picks, or all of them
+func archive(input string, opts Options, tp trace.Trace) ([]unpack.Member, error) {
+	return unpack.Members(input, opts[members.Name], tp)
+}
+
+// harDocuments lexes each response in a HAR archive by its mime type,
+// or by detecting it if the mime type doesn't say.
+func harDocuments(ctx context.Context, input string, opts Options, tp trace.Trace) ([]Document, error) {
+	var docs []Document
+
+	defer tp.Begin()()
+	entries, err := har.Entries(input, tp)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		inputType := e.Type()
+		if inputType == "" {
+			if f, ok := Detect(e.Body, tp); ok {
+				inputType = f.Name
+			}
+		}
+		if inputType != "xml" && inputType != "json" {
+			tp.Printf("skipping %s, %q isn't xml or json\n", e.Name(), e.MimeType)
+			continue
+		}
+		d, err := lex(ctx, inputType, e.Body, opts, tp)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, Document{Name: e.Name(), Tokens: d})
+	}
+	return docs, nil
+}
+
+// soapDocuments lexes the body of a SOAP envelope, with the fault if
+// it holds one
+func soapDocuments(ctx context.Context, input string, _ Options, tp trace.Trace) ([]Document, error) {
+	tokens, err := soap.LexContext(ctx, input, tp)
+	if fault, ok := err.(*soap.Fault); ok {
+		return []Document{{Tokens: tokens, Fault: fault}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return []Document{{Tokens: tokens}}, nil
+}
+
+// logDocuments lexes each json, and with -logxml each xml, fragment
+// found in the lines of input, naming each by its line number
+func logDocuments(ctx context.Context, input string, opts Options, tp trace.Trace) ([]Document, error) {
+	var docs []Document
+
+	defer tp.Begin()()
+	for _, f := range fragment.Scan(input, opts.Bool("logxml"), tp) {
+		d, err := lex(ctx, f.Type, f.Text, opts, tp)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, Document{Name: f.Name(), Tokens: d})
+	}
+	return docs, nil
+}
+
+// lex lexes a single document of a named format
+func lex(ctx context.Context, name, input string, opts Options, tp trace.Trace) ([]token.Token, error) {
+	f, ok := Lookup(name)
+	if !ok || f.Lex == nil {
+		return nil, fmt.Errorf("no %s format to lex with", name)
+	}
+	docs, err := f.Lex(ctx, input, opts, tp)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0].Tokens, nil
+}
+
+// isXML looks for text with the telling parts of xml
+func isXML(s string) bool {
+	return !isBinary(s) && (strings.Contains(s, "<?xml") ||
+		strings.Contains(s, "</") || strings.Contains(s, "/>"))
+}
+
+// isBinary reports whether s looks like binary data rather than text
+func isBinary(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	for _, r := range s {
+		if r < ' ' && r != '\t' && r != '\n' && r != '\r' {
+			return true
+		}
+	}
+	return false
+}
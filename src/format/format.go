@@ -0,0 +1,200 @@
+// Package format -- a registry of the kinds of input jxpath can query. A
+// format registers its name, how to recognize it, any options it takes
+// and how to lex it, and the command-line enumerates whatever is
+// registered, so a format can be added without editing main.
+package format
+
+import (
+	"lexer"
+	"token"
+	"trace"
+	"unpack"
+
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Document is one lexed input. Formats like HAR contain several, whose
+// names are used to tag the results.
+type Document struct {
+	Name   string // where the tokens came from, empty if there's only one
+	Tokens []token.Token
+	Fault  error  // a SOAP fault, which is reported but can still be queried
+}
+
+// Option is an option a format takes, which is also its command-line
+// flag, as in -logxml
+type Option struct {
+	Name  string
+	Usage string // the flag's help
+	Bool  bool   // it's set or not, rather than taking a value
+}
+
+// Options are the values of the formats' options, by name, as set on the
+// command line. One that isn't set is "".
+type Options map[string]string
+
+// Bool reports whether a boolean option is set
+func (o Options) Bool(name string) bool {
+	b, _ := strconv.ParseBool(o[name])
+	return b
+}
+
+// Format is a kind of input
+type Format struct {
+	Name     string // also its command-line flag, as in -json
+	Usage    string // the flag's help
+	Priority int    // the order formats are detected in, lowest first
+
+	// Detect reports whether input is of this format. If it's nil,
+	// the format is only used when asked for by name.
+	Detect func(input string) bool
+
+	// Options are the options the format takes, if any. Formats can
+	// share one, as zip and tar share -members.
+	Options []Option
+
+	// Lex lexes input into one or more documents. It's nil for a
+	// container, and may be for a format with a Start func, which it's
+	// then made from.
+	Lex func(ctx context.Context, input string, opts Options, tp trace.Trace) ([]Document, error)
+
+	// Unpack returns the members of a container, such as a zip archive,
+	// each of which is an input of its own, of whatever type it is. It's
+	// nil for a format that's lexed.
+	Unpack func(input string, opts Options, tp trace.Trace) ([]unpack.Member, error)
+
+	// Start lexes input as it's read, for streaming, or is nil if the
+	// whole input is needed first
+	Start func(ctx context.Context, r io.Reader, tp trace.Trace) *lexer.Lexer
+}
+
+var formats []Format // in detection order
+
+// reserved are jxpath's own flags, which neither a format nor an option
+// can be called
+var reserved = map[string]bool{"f": true, "r": true, "include": true, "workers": true,
+	"explain": true, "trace": true, "o": true, "first": true, "h": true, "help": true}
+
+// Register adds a format. It's an error for it to have the name of
+// another format, an option or one of jxpath's flags, or an option with
+// the name of a format or a flag, or of another format's option but not
+// its kind. A format with a Start func needn't have a Lex func as well.
+func Register(f Format) error {
+	if f.Name == "" || (f.Lex == nil && f.Start == nil) == (f.Unpack == nil) {
+		return fmt.Errorf("format %q needs a name and a Lex, Start or Unpack func", f.Name)
+	}
+	if err := taken(f.Name); err != nil {
+		return err
+	}
+	for _, o := range f.Options {
+		if o.Name == f.Name || reserved[o.Name] {
+			return fmt.Errorf("format %s's option %q is the name of a flag", f.Name, o.Name)
+		}
+		if _, ok := Lookup(o.Name); ok {
+			return fmt.Errorf("format %s's option %q is the name of a format", f.Name, o.Name)
+		}
+		if shared, ok := option(o.Name); ok && shared.Bool != o.Bool {
+			return fmt.Errorf("format %s's option %q is another format's, of another kind", f.Name, o.Name)
+		}
+	}
+	if f.Lex == nil && f.Start != nil {
+		f.Lex = fromStart(f.Start)
+	}
+	formats = append(formats, f)
+	sort.SliceStable(formats, func(i, j int) bool {
+		return formats[i].Priority < formats[j].Priority
+	})
+	return nil
+}
+
+// Unregister removes a format, if there's one of that name
+func Unregister(name string) {
+	for i := range formats {
+		if formats[i].Name == name {
+			formats = append(formats[:i], formats[i+1:]...)
+			return
+		}
+	}
+}
+
+// taken reports why a format can't be called name, or nil if it can
+func taken(name string) error {
+	if reserved[name] {
+		return fmt.Errorf("format %q has the name of a flag", name)
+	}
+	if _, ok := Lookup(name); ok {
+		return fmt.Errorf("format %q is already registered", name)
+	}
+	if _, ok := option(name); ok {
+		return fmt.Errorf("format %q has the name of an option", name)
+	}
+	return nil
+}
+
+// option finds an option of the registered formats by name
+func option(name string) (Option, bool) {
+	for _, f := range formats {
+		for _, o := range f.Options {
+			if o.Name == name {
+				return o, true
+			}
+		}
+	}
+	return Option{}, false
+}
+
+// Formats returns the registered formats, in detection order
+func Formats() []Format {
+	return append([]Format(nil), formats...)
+}
+
+// Lookup finds a format by name
+func Lookup(name string) (Format, bool) {
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Detect returns the first format, in detection order, that recognizes
+// input, or false if none does
+func Detect(input string, tp trace.Trace) (Format, bool) {
+	defer tp.Begin()()
+	for _, f := range formats {
+		if f.Detect != nil && f.Detect(input) {
+			tp.Printf("detected %s\n", f.Name)
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// FromStates makes a Lex func from a lexer's start state, for a format
+// that lexes a single document with the shared lexer.Lexer
+func FromStates(start lexer.StateFn) func(context.Context, string, Options, trace.Trace) ([]Document, error) {
+	return func(ctx context.Context, input string, _ Options, tp trace.Trace) ([]Document, error) {
+		return []Document{{Tokens: lexer.Lex(ctx, input, start, tp)}}, nil
+	}
+}
+
+// fromStart makes a Lex func from a Start func, lexing a string as if
+// it were being read
+func fromStart(start func(context.Context, io.Reader, trace.Trace) *lexer.Lexer) func(context.Context, string, Options, trace.Trace) ([]Document, error) {
+	return func(ctx context.Context, input string, _ Options, tp trace.Trace) ([]Document, error) {
+		return []Document{{Tokens: start(ctx, strings.NewReader(input), tp).Tokens()}}, nil
+	}
+}
+
+// single makes a Lex func from one of the lexers' Lex funcs
+func single(lex func(context.Context, string, trace.Trace) []token.Token) func(context.Context, string, Options, trace.Trace) ([]Document, error) {
+	return func(ctx context.Context, input string, _ Options, tp trace.Trace) ([]Document, error) {
+		return []Document{{Tokens: lex(ctx, input, tp)}}, nil
+	}
+}
@@ -0,0 +1,118 @@
+// Package fragment -- finds json and xml embedded in lines of text, such
+// as service logs, so each can be lexed as a document of its own.
+package fragment
+
+import (
+	"trace"
+
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fragment is a json object or array, or an xml element, found in a line
+type Fragment struct {
+	Line int    // line number, from 1
+	Type string // "json" or "xml"
+	Text string
+}
+
+// Name is how a fragment is identified in results, by line number
+func (f Fragment) Name() string {
+	return fmt.Sprintf("line %d", f.Line)
+}
+
+// Scan looks through each line of input, left to right, for well-formed
+// json objects and arrays and, if withXML is set, xml elements. A fragment
+// must start and end on the same line. Text that merely looks like one,
+// such as "[INFO]", is skipped.
+func Scan(input string, withXML bool, tp trace.Trace) []Fragment {
+	var fragments []Fragment
+
+	defer tp.Begin()()
+	for n, line := range strings.Split(input, "\n") {
+		for i := 0; i < len(line); i++ {
+			var end int
+			var typ string
+
+			switch line[i] {
+			case '{', '[':
+				end, typ = jsonEnd(line[i:]), "json"
+			case '<':
+				if withXML {
+					end, typ = xmlEnd(line[i:]), "xml"
+				}
+			}
+			if end == 0 {
+				continue
+			}
+			tp.Printf("line %d has %s %.40q\n", n+1, typ, line[i:i+end])
+			fragments = append(fragments, Fragment{Line: n + 1, Type: typ, Text: line[i : i+end]})
+			i += end - 1
+		}
+	}
+	return fragments
+}
+
+// jsonEnd returns the length of the json object or array that s starts
+// with, or 0 if it doesn't start with a valid one
+func jsonEnd(s string) int {
+	var depth int
+	var inString bool
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if inString {
+			if c == '\\' {
+				i++ // skip the escaped character
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			depth--
+			if depth == 0 {
+				if json.Valid([]byte(s[:i+1])) {
+					return i + 1
+				}
+				return 0
+			}
+		}
+	}
+	return 0
+}
+
+// xmlEnd returns the length of the xml element that s starts with,
+// or 0 if it doesn't start with a well-formed one
+func xmlEnd(s string) int {
+	var depth int
+
+	if r, _ := utf8.DecodeRuneInString(s[1:]); !unicode.IsLetter(r) {
+		return 0
+	}
+	d := xml.NewDecoder(strings.NewReader(s))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return 0
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+			if depth == 0 {
+				return int(d.InputOffset())
+			}
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Package har -- reader for HTTP archives, the json files that browsers
+// and proxies export. It unpacks the responses so that the xml and json
+// lexers can treat each one as a document of its own.
+package har
+
+import (
+	"trace"
+
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// archive is the part of a HAR file we care about: the log's entries
+// and, in each, the request url and the response's content.
+type archive struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method string `json:"method"`
+				URL    string `json:"url"`
+			} `json:"request"`
+			Response struct {
+				Status  int `json:"status"`
+				Content struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+					Encoding string `json:"encoding"`
+				} `json:"content"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+// IsHAR reports whether input is shaped like a HAR file: a json object
+// whose log is an object with a version and an array of entries. Json
+// that merely mentions a log and its entries, as logs do, isn't one.
+// The input may be only the start of a file, so one that ends once its
+// log has shown its version and entries is taken to be a HAR file.
+func IsHAR(input string) bool {
+	if !strings.Contains(input, `"log"`) {
+		// not worth decoding
+		return false
+	}
+	dec := json.NewDecoder(strings.NewReader(input))
+	log, err := shape(dec)
+	return log && (err == nil || err == io.EOF || err == io.ErrUnexpectedEOF)
+}
+
+// errShape is the error when json isn't shaped like a HAR file
+var errShape = errors.New("not a HAR file")
+
+// shape reads a json object, reporting whether its log has a version
+// and entries. It stops with an error where the input isn't shaped like
+// a HAR file, or ends.
+func shape(dec *json.Decoder) (log bool, err error) {
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return false, errShape
+	}
+	for {
+		key, err := dec.Token()
+		if err != nil {
+			return log, err
+		}
+		if key == json.Delim('}') {
+			break
+		}
+		if key == "log" {
+			log, err = logShape(dec)
+		} else {
+			err = skip(dec, 0)
+		}
+		if err != nil {
+			return log, err
+		}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		// there's more after it
+		return false, errShape
+	}
+	return log, nil
+}
+
+// logShape reads the log's object, reporting whether it has a version
+// and an array of entries, as far as it goes
+func logShape(dec *json.Decoder) (bool, error) {
+	var version, entries bool
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return false, errShape
+	}
+	for {
+		var tok json.Token
+		key, err := dec.Token()
+		if err != nil {
+			return version && entries, err
+		}
+		if key == json.Delim('}') {
+			return version && entries, nil
+		}
+		switch key {
+		case "version":
+			if tok, err = dec.Token(); err != nil {
+				return false, err
+			}
+			if _, version = tok.(string); !version && tok != nil {
+				return false, errShape
+			}
+		case "entries":
+			if tok, err = dec.Token(); err != nil {
+				return false, err
+			}
+			if entries = tok == json.Delim('['); !entries && tok != nil {
+				return false, errShape
+			}
+			if entries {
+				err = skip(dec, 1)
+			}
+		default:
+			err = skip(dec, 0)
+		}
+		if err != nil {
+			return version && entries, err
+		}
+	}
+}
+
+// skip reads the rest of a value, in depth arrays or objects, so a
+// depth of 0 skips a whole one
+func skip(dec *json.Decoder, depth int) error {
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth <= 0 {
+			return nil
+		}
+	}
+}
+
+// Entry is one captured response, with its body already decoded
+type Entry struct {
+	Index    int    // position in log.entries
+	URL      string // the request's url
+	MimeType string // the response's content type
+	Body     string // the response's text, base64-decoded if need be
+}
+
+// Entries decodes a HAR file and returns the responses that have a body.
+// Entries without a body, such as redirects, are skipped.
+func Entries(input string, tp trace.Trace) ([]Entry, error) {
+	var a archive
+	var entries []Entry
+
+	defer tp.Begin()()
+	if err := json.Unmarshal([]byte(input), &a); err != nil {
+		return nil, fmt.Errorf("not a HAR file, %v", err)
+	}
+	for i, e := range a.Log.Entries {
+		body := e.Response.Content.Text
+		if e.Response.Content.Encoding == "base64" {
+			b, err := base64.StdEncoding.DecodeString(body)
+			if err != nil {
+				return nil, fmt.Errorf("entry %d, %s: bad base64 content, %v",
+					i, e.Request.URL, err)
+			}
+			body = string(b)
+		}
+		if strings.TrimSpace(body) == "" {
+			tp.Printf("entry %d, %s has no body, skipped\n", i, e.Request.URL)
+			continue
+		}
+		entries = append(entries, Entry{Index: i, URL: e.Request.URL,
+			MimeType: e.Response.Content.MimeType, Body: body})
+	}
+	return entries, nil
+}
+
+// Type maps the entry's mime type onto the lexer to use: "xml", "json" or
+// "" if the mime type doesn't say, in which case the caller has to guess.
+func (e Entry) Type() string {
+	mime := strings.ToLower(e.MimeType)
+	if i := strings.Index(mime, ";"); i >= 0 {
+		// drop parameters like charset=utf-8
+		mime = mime[:i]
+	}
+	mime = strings.TrimSpace(mime)
+	switch {
+	case strings.HasSuffix(mime, "/json") || strings.HasSuffix(mime, "+json"):
+		return "json"
+	case strings.HasSuffix(mime, "/xml") || strings.HasSuffix(mime, "+xml"):
+		return "xml"
+	}
+	return ""
+}
+
+// Name is how an entry is identified in results, by index and url
+func (e Entry) Name() string {
+	return fmt.Sprintf("entries[%d] %s", e.Index, e.URL)
+}
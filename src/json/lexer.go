@@ -6,7 +6,9 @@ import (
 	"trace"
 	"lexer"
 
+	"context"
 	"fmt"
+	"io"
 	"strings"
 	"unicode"
 )
@@ -15,7 +17,7 @@ import (
 
 // stateFn represents the state of the scanner
 // as a function that returns the next state.
-type stateFn func(*lexer.Lexer) stateFn
+type stateFn = lexer.StateFn
 
 // Type jLex composes a low-level Lexer into this one
 type jLex struct {
@@ -25,51 +27,31 @@ type jLex struct {
 
 const eof = -1  	// see note in lexer re is this good or not
 
+// Arrays are marked on the stack by prefixing the array's name with one
+// of these. An array's elements each become a BEGIN/END pair with the
+// array's name, so they can be indexed like repeated xml tags. An array
+// directly inside an array keeps its enclosing element open around it.
+const (
+	arrayMark  = "\x00["
+	nestedMark = "\x00[["
+)
+
 // Lex is the entry point to the json lexer
 func Lex(input string, tp trace.Trace) ([]token.Token) {
-	
-	var slice  = make([]token.Token, 0)
-	input = strings.TrimSpace(input)
-	l := lexer.New(input, make(chan token.Token), tp)
-	defer l.Begin()()
-
-	go run(l) // closes pipe
-	slice = parse(l, slice)
-	l.Printf("returning %s\n", slice)
-	return slice
+	return LexContext(context.Background(), input, tp)
 }
 
-// parse accepts the lexemes from run and returns when it has them all
-// Right now it's the null parser. Not shared, as it's not always going
-// to be null.
-func parse(l *lexer.Lexer, slice []token.Token) []token.Token {
-	var tok token.Token
-
-	//defer l.Begin()()
-	for {
-		tok = <- l.Pipe
-		slice = append(slice, tok)
-		//l.Printf("parse: appending %v to the slice\n", tok)
-		if tok.Typ == token.EOF || tok.Typ == token.ERROR {
-			l.Printf("at end, token = %s", tok)
-			break
-		}
-	}
-	//l.Printf("parse: at end of parse loop, slice = %v\n", slice)
-	return slice
+// LexContext is Lex until ctx is cancelled or its deadline passes, when
+// the tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) ([]token.Token) {
+	return lexer.Lex(ctx, input, lexUnnamedBegin, tp)
 }
 
-// Run lexes the Input by executing state functions until
-// the state is nil, then closes its output
-func run(l *lexer.Lexer) {
-	defer l.Begin()()
-
-	for state := lexUnnamedBegin; state != nil; {
-		state = state(l)
-	}
-	// FIXME is this reached? Yes, I had a *t vs t bug!
-	l.Print("At end of l.run(), is this recorded?")
-	close(l.Pipe)
+// Start starts lexing json as it's read, returning the running lexer, so
+// only the tokens need be kept in memory, not the document. Its Tokens
+// are LexContext's.
+func Start(ctx context.Context, r io.Reader, tp trace.Trace) *lexer.Lexer {
+	return lexer.Start(ctx, r, lexUnnamedBegin, tp)
 }
 
 
@@ -78,14 +60,21 @@ func run(l *lexer.Lexer) {
 func lexUnnamedBegin(l *lexer.Lexer) stateFn {
 	defer l.Begin()()
 
-	l.Printf("starting with %.40q ...\n",l.Rest())
+	l.Printf("starting with %q ...\n", l.Ahead(40))
 	l.SkipOver()
-	if strings.HasPrefix(l.Rest(), "{") {
+	if l.HasPrefix("{") {
 		l.Next()
 		l.Emit(token.BEGIN, "")
 		l.Push("<unnamed>")
 		return lexName
 	}
+	if l.HasPrefix("[") {
+		// an array of unnamed elements
+		l.Next()
+		l.Emit(token.BEGIN, "")
+		l.Push("")
+		return lexArray
+	}
 	// otherwise start looking for a name
 	return lexName
 }
@@ -95,7 +84,11 @@ func lexName(l *lexer.Lexer) stateFn {
 	var cantidateName string
 	defer l.Begin()()
 
-	l.Printf("starting with %.40q ...\n",l.Rest())
+	if _, _, ok := arrayOf(l.Top()); ok {
+		// we're between the elements of an array, not names
+		return lexElement
+	}
+	l.Printf("starting with %q ...\n", l.Ahead(40))
 	l.SkipOver()
 	// Expect },  letters, qstring, or eof
 	var nextc = l.Next()
@@ -108,10 +101,8 @@ func lexName(l *lexer.Lexer) stateFn {
 
 	} else 	if nextc == '"' {
 		// Found a double-quote, it's a qstring
-		l.Ignore()
-		cantidateName = l.AcceptVariableName()
-		l.Next()
-		l.Ignore()
+		l.Backup()
+		cantidateName = l.AcceptQstring()
 		l.Printf("got quoted text `%s`\n", cantidateName)
 
 	} else if unicode.IsLetter(rune(nextc)) {
@@ -133,7 +124,7 @@ func lexName(l *lexer.Lexer) stateFn {
 	// Postcondtion: we have a name, candidate for a <BEGIN name>
 
 	// expect a colon
-	l.Printf("continuing with %.40q ...\n", l.Rest())
+	l.Printf("continuing with %q ...\n", l.Ahead(40))
 	l.SkipOver()
 	nextc = l.Next()
 	if nextc == ':' {
@@ -152,14 +143,15 @@ func lexName(l *lexer.Lexer) stateFn {
 	}
 }
 
-// lexValue recognizes begin-block ("{") and qstring values
+// lexValue recognizes begin-block ("{"), begin-array ("["), qstring
+// and literal values
 func lexValue(l *lexer.Lexer) stateFn {
 	var cantidateValue string
 	defer l.Begin()()
-	l.Printf("starting with %.40q ...\n",l.Rest())
+	l.Printf("starting with %q ...\n", l.Ahead(40))
 	l.SkipOver()
 
-	// Expect {, qstring, or eof
+	// Expect {, [, qstring, literal or eof
 	var nextc = l.Next()
 	if nextc == '"' {
 		// Found a double-quote, it's a qstring
@@ -176,6 +168,19 @@ func lexValue(l *lexer.Lexer) stateFn {
 		l.Ignore()
 		return lexName
 
+	} else if (nextc == '[') {
+		l.Ignore()
+		return lexArray
+
+	} else if nextc == '-' || unicode.IsDigit(rune(nextc)) || unicode.IsLetter(rune(nextc)) {
+		// A number, or one of true, false and null
+		l.Backup()
+		cantidateValue = acceptLiteral(l)
+		l.Emit(token.VALUE, cantidateValue)
+		name := l.Pop()
+		l.Emit(token.END, name)
+		return lexName
+
 	} else if (nextc == eof) {
 		// we've fallen off the end unexpectedly
 		l.Emit(token.EOF, "")
@@ -185,6 +190,91 @@ func lexValue(l *lexer.Lexer) stateFn {
 	return nil
 }
 
+// lexArray starts an array, just after the "[". The BEGIN of the array's
+// name has already been emitted, and serves for the first element.
+func lexArray(l *lexer.Lexer) stateFn {
+	defer l.Begin()()
+
+	name := l.Pop()
+	mark := arrayMark
+	if _, _, ok := arrayOf(l.Top()); ok {
+		// an array in an array: the element stays open around this one
+		l.Push(name)
+		mark = nestedMark
+	}
+	l.Push(mark + name)
+	l.SkipOver()
+	if l.HasPrefix("]") {
+		// an empty array, end the element we began
+		l.Next()
+		l.Ignore()
+		l.Pop()
+		if mark == nestedMark {
+			l.Pop()
+		}
+		l.Emit(token.END, name)
+		return lexName
+	}
+	if mark == nestedMark {
+		l.Emit(token.BEGIN, name)
+	}
+	l.Push(name)
+	return lexValue
+}
+
+// lexElement continues an array after one of its elements, with either
+// the next element or a "]"
+func lexElement(l *lexer.Lexer) stateFn {
+	defer l.Begin()()
+
+	l.SkipOver()
+	var nextc = l.Next()
+	if nextc == ']' {
+		l.Ignore()
+		_, nested, _ := arrayOf(l.Pop())
+		if nested {
+			// end the element this array was in
+			l.Emit(token.END, l.Pop())
+		}
+		return lexName
+
+	} else if nextc == eof {
+		l.Emit(token.EOF, "")
+		return nil
+	}
+	l.Backup()
+	name, _, _ := arrayOf(l.Top())
+	l.Push(name)
+	l.Emit(token.BEGIN, name)
+	return lexValue
+}
+
+// arrayOf returns the name of the array a stack entry marks, and whether
+// it's an array in an array. It returns false if the entry isn't an array.
+func arrayOf(s string) (string, bool, bool) {
+	if strings.HasPrefix(s, nestedMark) {
+		return s[len(nestedMark):], true, true
+	}
+	if strings.HasPrefix(s, arrayMark) {
+		return s[len(arrayMark):], false, true
+	}
+	return "", false, false
+}
+
+// acceptLiteral accepts a number or one of true, false and null
+func acceptLiteral(l *lexer.Lexer) string {
+	var nextc int
+
+	for {
+		nextc = l.Next()
+		if !unicode.IsLetter(rune(nextc)) && !unicode.IsDigit(rune(nextc)) &&
+			!strings.ContainsRune("+-.", rune(nextc)) {
+			break
+		}
+	}
+	l.Backup()
+	return l.Current()
+}
 
 /*
  * Things to test
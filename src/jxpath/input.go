@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// decompressReader is decompress for a stream: it undoes gzip, bzip2
+// or zlib compression as the input is read
+func decompressReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+
+	switch compression(magic) {
+	case "gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("bad gzip input, %v", err)
+		}
+		return zr, nil
+	case "bzip2":
+		return bzip2.NewReader(br), nil
+	case "zlib":
+		// text can begin like a zlib header, so it's only zlib if what
+		// follows the header inflates
+		head, _ := br.Peek(trial)
+		if !inflates(head) {
+			return br, nil
+		}
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("bad zlib input, %v", err)
+		}
+		return zr, nil
+	}
+	return br, nil
+}
+
+// sniff is how much of the start of an input its type is guessed from,
+// when it can be lexed as it's read
+const sniff = 64 << 10
+
+// whole returns the start of an input as a string, without the part of
+// a character cut off at its end
+func whole(head []byte) string {
+	for i := len(head) - 1; i >= 0 && i >= len(head)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(head[i]) {
+			if !utf8.FullRune(head[i:]) {
+				head = head[:i]
+			}
+			break
+		}
+	}
+	return string(head)
+}
+
+// trial is how much of what may be zlib is inflated to see if it is
+const trial = 512
+
+// fileList is the input files named by repeated -f options
+type fileList []string
+
+func (f *fileList) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fileList) Set(name string) error {
+	*f = append(*f, name)
+	return nil
+}
+
+// splitArgs divides the command-line arguments into path expressions
+// and, after a "--", the names of files, which follow any named by -f
+func splitArgs(args []string, files []string) (expressions, names []string) {
+	names = append(names, files...)
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], append(names, args[i+1:]...)
+		}
+	}
+	return args, names
+}
+
+// readFile reads and decompresses a named input file, or stdin if
+// the name is "-"
+func readFile(name string) (string, error) {
+	f, err := openFile(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// pipes report a size of zero, so read until EOF
+	return readInput(f)
+}
+
+// openFile opens a named input file, or stdin if the name is "-"
+func openFile(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(name)
+}
+
+// readInput reads all of an input, decompressing it if need be, so
+// that guessType and the lexers see the document itself
+func readInput(r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	data, err = decompress(data)
+	return string(data), err
+}
+
+// decompress undoes gzip, bzip2 or zlib compression, recognized by its
+// magic number. Anything else is returned unchanged.
+func decompress(data []byte) ([]byte, error) {
+	r, err := decompressReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("bad compressed input, %v", err)
+	}
+	return plain, nil
+}
+
+// compression recognizes gzip, bzip2 or zlib compression by the magic
+// number at the start of the input, returning "" if it's none of them
+func compression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, []byte("\x1f\x8b")):
+		return "gzip"
+	case bytes.HasPrefix(magic, []byte("BZh")) && len(magic) > 3 &&
+		magic[3] >= '1' && magic[3] <= '9':
+		return "bzip2"
+	case isZlib(magic):
+		return "zlib"
+	}
+	return ""
+}
+
+// isZlib looks for a zlib header: deflate, a 32K window, and a
+// check-sum that makes the first two bytes a multiple of 31. Text such
+// as "x " passes too.
+func isZlib(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x78 &&
+		(int(data[0])<<8 | int(data[1])) % 31 == 0
+}
+
+// inflates reports whether the start of the input decompresses as zlib,
+// as far as it goes. If head is shorter than a trial, it's all there is,
+// so it has to be all of a zlib stream.
+func inflates(head []byte) bool {
+	zr, err := zlib.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return false
+	}
+	_, err = io.Copy(ioutil.Discard, zr)
+	return err == nil || err == io.ErrUnexpectedEOF && len(head) == trial
+}
+
+// displayName is how a file is named in results and errors
+func displayName(name string) string {
+	if name == "-" {
+		return "(standard input)"
+	}
+	return name
+}
+
+// walkFiles returns the regular files under dir, in lexical order,
+// skipping hidden directories. If glob isn't empty, only files whose
+// base names match it, such as "*.json", are returned.
+func walkFiles(dir, glob string) ([]string, error) {
+	var names []string
+
+	if _, err := filepath.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("bad file pattern %q, %v", glob, err)
+	}
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if glob != "" {
+			if ok, _ := filepath.Match(glob, fi.Name()); !ok {
+				return nil
+			}
+		}
+		names = append(names, path)
+		return nil
+	})
+	return names, err
+}
@@ -2,88 +2,128 @@ package main
 
 import (
 	"token"
-	xml_lexer "xml"		// lexer for xml
-	json_lexer "json" 	// and for json
+	"format"	// the lexers for each kind of input
 	"pathExpr"
 	"trace"
 
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"flag"
 	"os"
+	"io"
 	"io/ioutil"
-	"strings"
+	"runtime"
 )
 
 
 /*
  * Parse an input string into a slice of tokens, as input for
  * one or more path expressions. Proof of concept for a general
- * path expression engine. Returns the result as a string on stdout,
- * 0 on success an 1 on error or warnings. Right now there are only
- * warnings.
+ * path expression engine. Prints each element an expression selects
+ * on a line of its own on stdout, or with -o json, all of them as one
+ * json array. Warnings are only printed, and the exit status is
+ *	0 if every expression selected something,
+ *	1 for a bad command line or path expression,
+ *	2 if the input holds a SOAP fault,
+ *	3 if some input couldn't be read,
+ *	4 if an expression selected nothing, and
+ *	5 if an = comparison matched more than one element,
+ * or where several apply, the first of 3, 2, 4 and 5.
+ * Input is read from stdin, or from files named with -f or after
+ * a "--", each of which may be of a different type. A file named
+ * "-" is stdin, which may be a pipe. With -r, the files under a
+ * directory are read, several at a time, and reported in path order.
+ * Input that's -json or -xml is evaluated as it's read, which stops as
+ * soon as nothing more can be selected. With -first, only the first
+ * element each expression selects is wanted, so that can be sooner.
+ * -explain shows the calls that find the first.
+ * The input types are those registered with the format package.
  */
 func main() {
-	var source string
-	var pathExpression string
 	var inputType string
 	var t trace.Trace
-	var x, j, c, explain, tracing bool
+	var explain, tracing bool
+	var status int
+	var opts = make(format.Options)
+	var optionNames = make(map[string]bool)
+	var files, dirs fileList
+	var include string
+	var workers int
+	var out = output{w: os.Stdout}
 
-	flag.BoolVar(&x, "xml", false, "parse xml input")
-	flag.BoolVar(&j, "json", false, "parse json input")
-	flag.BoolVar(&c, "csv", false, "parse csv input")
-	flag.BoolVar(&explain, "explain", false, "explain what code to use")
+	// Each format has a flag of its own, and perhaps options, which are
+	// flags too
+	var asked = make(map[string]*bool)
+	for _, f := range format.Formats() {
+		asked[f.Name] = flag.Bool(f.Name, false, f.Usage)
+		for _, o := range f.Options {
+			if optionNames[o.Name] {
+				continue
+			}
+			optionNames[o.Name] = true
+			if o.Bool {
+				flag.Bool(o.Name, false, o.Usage)
+			} else {
+				flag.String(o.Name, "", o.Usage)
+			}
+		}
+	}
+	flag.Var(&files, "f", "read input from `file`, which may be repeated")
+	flag.Var(&dirs, "r", "read the files under `directory`, which may be repeated")
+	flag.StringVar(&include, "include", "", "with -r, read only files whose names match a `glob`")
+	flag.IntVar(&workers, "workers", runtime.NumCPU(), "read, lex and evaluate up to `n` files at once")
+	flag.BoolVar(&explain, "explain", false, "explain what code finds the first element selected")
 	flag.BoolVar(&tracing, "trace", false, "trace in detail")
+	flag.StringVar(&out.format, "o", "lines", "print results as `lines` or json")
+	flag.BoolVar(&out.first, "first", false, "print only the first element each expression selects, reading -json or -xml input only until they're found")
 
 	flag.Parse();
-	if x {
-		if j || c {
-			fmt.Fprint(os.Stderr, "more than one of -x, -j and -c called, -x taken\n")
-			flag.Usage()
+	flag.Visit(func(fl *flag.Flag) {
+		if optionNames[fl.Name] {
+			opts[fl.Name] = fl.Value.String()
 		}
-		inputType = "xml"
-
-	} else if j {
-		if c {
-			fmt.Fprint(os.Stderr, "more than one of -j and -c called, -j taken\n")
+	})
+	// The first input type set is taken, in detection order
+	for _, f := range format.Formats() {
+		if !*asked[f.Name] {
+			continue
+		}
+		if inputType != "" {
+			fmt.Fprintf(os.Stderr, "more than one input type called, -%s taken\n", inputType)
 			flag.Usage()
+			break
 		}
-		inputType = "json"
-
-	} else if c {
-		inputType = "csv"
+		inputType = f.Name
+	}
+	if out.format != "lines" && out.format != "json" {
+		fmt.Fprintf(os.Stderr, "-o %s isn't lines or json\n", out.format)
+		os.Exit(1)
 	}
 
 
-	// Look for path expressions on the command-line
-	// In future, allow one or more files|path-expressions
-	if flag.NArg() == 0 {
-		fmt.Fprint(os.Stderr, "Usage: jxpath path-expression*\n  Options:\n")
+	// Look for path expressions, and any files after a --, on the command-line
+	expressions, names := splitArgs(flag.Args(), files)
+	if len(expressions) == 0 {
+		fmt.Fprint(os.Stderr, "Usage: jxpath path-expression* [-- file*]\n  Options:\n")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-
-	// Look on stdin for input data
-	file := os.Stdin
-	fi, err := file.Stat()
-	if err != nil {
-		// Stdin is broken?  Not much we can do.
-		fmt.Println("os.Stdin failed to stat, halting", err)
-		os.Exit(3)
-
-	} else if fi.Size() > 0 {
-		bytes, err := ioutil.ReadAll(os.Stdin)
+	// Each expression is compiled once, however many inputs there are
+	var exprs []*pathExpr.Expr
+	for _, expression := range expressions {
+		e, err := pathExpr.Compile(expression)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading stdin, %s, halting", err);
-			os.Exit(3)
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
 		}
-		source = string(bytes)
-
-	} else {
-		// Report there wasn't anything to do
-		flag.Usage()
-		fmt.Fprint(os.Stderr, "No input was found on stdin, halting\n")
-		os.Exit(1)
+		if explain {
+			// Write it to stderr for the engineer to copy
+			fmt.Fprintf(os.Stderr, "explanation: %s\n", e.Explain())
+		}
+		exprs = append(exprs, e)
 	}
 
 	// Single trace stream if turned on, otherwise silent.
@@ -97,58 +137,395 @@ func main() {
 	defer t.Begin()()
 	t.Printf("args=%s\n", flag.Args())
 
-	if (inputType == "") {
+	for _, dir := range dirs {
+		found, err := walkFiles(dir, include)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, %s\n", dir, err)
+			status = worse(status, 3)
+		}
+		names = append(names, found...)
+	}
+	if len(names) == 0 && len(dirs) > 0 {
+		fmt.Fprint(os.Stderr, "No input files were found, halting\n")
+		os.Exit(1)
+	}
+	if len(names) == 0 {
+		// Look on stdin for input data, unless it's a terminal
+		if isTerminal(os.Stdin) {
+			flag.Usage()
+			fmt.Fprint(os.Stderr, "No input was found on stdin, which is a terminal, halting\n")
+			os.Exit(1)
+		}
+		names = []string{"-"}
+	}
+
+	// Each file has its own type, and is named if there's more than one
+	named := len(names) > 1 || len(dirs) > 0
+	for in := range evalFiles(names, named, inputType, opts, exprs, out.first, workers, t) {
+		if in.err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading %s, %s\n", displayName(in.name), in.err)
+			status = worse(status, 3)
+			continue
+		}
+		for _, d := range in.docs {
+			if d.fault != nil {
+				// report it, but still allow queries of the fault
+				fmt.Fprintf(os.Stderr, "%s%s\n", d.prefix(), d.fault)
+				status = worse(status, 2)
+			}
+			for i, e := range exprs {
+				out.report(d.name, i, e, d.results[i], d.errs[i])
+				status = worse(status, statusOf(d.errs[i]))
+			}
+		}
+	}
+	out.flush()
+	if status != 0 {
+		os.Exit(status)
+	}
+}
+
+// statusOf returns the exit status for an expression's error: 4 if it
+// selected nothing, 5 if a comparison was ambiguous
+func statusOf(err error) int {
+	var notFound *pathExpr.NotFoundError
+	var ambiguous *pathExpr.AmbiguousError
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &notFound):
+		return 4
+	case errors.As(err, &ambiguous):
+		return 5
+	}
+	return 1
+}
+
+// seriousness ranks the exit statuses, least serious first
+var seriousness = map[int]int{0: 0, 5: 1, 4: 2, 2: 3, 3: 4, 1: 5}
+
+// worse returns the more serious of two exit statuses
+func worse(status, other int) int {
+	if seriousness[other] > seriousness[status] {
+		return other
+	}
+	return status
+}
+
+// document is one lexed input. Inputs like HAR files contain several,
+// and their names are used to tag the results.
+type document struct {
+	name   string // where the tokens came from, empty if there's only one
+	tokens []token.Token
+	fault  error  // a SOAP fault, which is reported but can still be queried
+}
+
+// prefix returns the grep-style "name: " to put before a result
+func (d document) prefix() string {
+	if d.name == "" {
+		return ""
+	}
+	return d.name + ": "
+}
+
+// evaluated is what the expressions selected in a document, whose
+// tokens are dropped once they're evaluated
+type evaluated struct {
+	document
+	results []*pathExpr.Result // by expression
+	errs    []error
+}
+
+// input is what was selected in the documents read from one file, or
+// why they couldn't be
+type input struct {
+	name string
+	docs []evaluated
+	err  error
+}
+
+// evalFiles reads, lexes and evaluates files with a pool of workers,
+// sending what was selected in each on the channel it returns, in the
+// same order as names, as soon as it and those before it are done. The
+// workers get only so far ahead of the file being sent, so no more than
+// a few files' results are held at once.
+func evalFiles(names []string, named bool, inputType string, opts format.Options, exprs []*pathExpr.Expr,
+	first bool, workers int, t trace.Trace) <-chan input {
+	var inputs = make(chan input)
+	var done = make([]chan input, len(names)) // each file's, when it's ready
+
+	defer t.Begin(names, workers)()
+	if workers < 1 {
+		workers = 1
+	}
+	for i := range done {
+		done[i] = make(chan input, 1)
+	}
+	next := make(chan int)
+	ahead := make(chan struct{}, 2*workers) // a slot for each file begun but not sent
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				done[i] <- evalFile(names[i], named, inputType, opts, exprs, first, t)
+			}
+		}()
+	}
+	go func() {
+		for i := range names {
+			ahead <- struct{}{}
+			next <- i
+		}
+		close(next)
+	}()
+	go func() {
+		for i := range names {
+			inputs <- <-done[i]
+			<-ahead
+		}
+		close(inputs)
+	}()
+	return inputs
+}
+
+// evalFile reads and lexes a file and evaluates the expressions on each
+// document in it. A format that can be lexed as it's read, given or
+// guessed from the start of the file, is evaluated as it is, and with
+// first, only until each expression has selected something. The rest
+// are read whole.
+func evalFile(name string, named bool, inputType string, opts format.Options, exprs []*pathExpr.Expr,
+	first bool, t trace.Trace) input {
+	var in = input{name: name}
+	var prefix string
+
+	if named {
+		prefix = displayName(name)
+	}
+	r, err := openFile(name)
+	if err != nil {
+		in.err = err
+		return in
+	}
+	defer r.Close()
+	dr, err := decompressReader(r)
+	if err != nil {
+		in.err = err
+		return in
+	}
+	br := bufio.NewReaderSize(dr, sniff)
+	guessed := inputType
+	if guessed == "" {
+		head, err := br.Peek(sniff)
+		if err == nil {
+			// there's more, so it may end part way through a character
+			guessed = guessType(whole(head), t)
+		} else {
+			guessed = guessType(string(head), t)
+		}
+	}
+	if f, ok := format.Lookup(guessed); ok && f.Start != nil {
+		return streamFile(name, prefix, f, br, exprs, first, t)
+	}
+	data, err := ioutil.ReadAll(br)
+	if err != nil {
+		in.err = fmt.Errorf("bad compressed input, %v", err)
+		return in
+	}
+	// what can't be streamed is guessed again from all of it
+	docs, err := documents(prefix, inputType, string(data), opts, t)
+	if err != nil {
+		in.err = err
+		return in
+	}
+	for _, d := range docs {
+		var ev = evaluated{document: document{name: d.name, fault: d.fault}}
+		path := pathExpr.NewPath(d.tokens, t)
+		for _, e := range exprs {
+			r, err := e.EvalTrace(path, t)
+			ev.results, ev.errs = append(ev.results, r), append(ev.errs, err)
+		}
+		in.docs = append(in.docs, ev)
+	}
+	return in
+}
+
+// documents lexes source as inputType, guessing it if it's empty, into
+// one or more documents named for name
+func documents(name, inputType, source string, opts format.Options, t trace.Trace) ([]document, error) {
+	var docs []document
+
+	defer t.Begin(name, inputType)()
+	if inputType == "" {
 		inputType = guessType(source, t)
 		t.Printf("mime-type=%s\n", inputType)
 	}
+	f, ok := format.Lookup(inputType)
+	if !ok {
+		t.Printf("skipping %s, its type wasn't guessed\n", name)
+		return nil, nil
+	}
+	if f.Unpack != nil {
+		return memberDocuments(name, f, source, opts, t)
+	}
+	found, err := f.Lex(context.Background(), source, opts, t)
+	for _, d := range found {
+		docs = append(docs, document{name: join(name, d.Name), tokens: d.Tokens, fault: d.Fault})
+	}
+	return docs, err
+}
 
-	var i int
-	switch (inputType) {
-	case "xml":
-		tokens := xml_lexer.Lex(source, t)
-		for i, pathExpression = range flag.Args() {
-			value := evaluate(tokens, pathExpression, explain, t)
-			fmt.Printf("%d: path expression %q selected %q\n", i, pathExpression, value)
+// memberDocuments lexes each member of a container, such as a zip or
+// tar archive, by its guessed type, naming each document for its member
+func memberDocuments(name string, f format.Format, source string, opts format.Options, t trace.Trace) ([]document, error) {
+	var docs []document
+
+	defer t.Begin(name, f.Name)()
+	members, err := f.Unpack(source, opts, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		data, err := decompress([]byte(m.Data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Name, err)
 		}
-	case "json":
-		tokens := json_lexer.Lex(source, t)
-		for i, pathExpression = range flag.Args() {
-			value := evaluate(tokens, pathExpression, explain, t)
-			fmt.Printf("%d: path expression %q selected %q\n", i, pathExpression, value)
+		d, err := documents(join(name, m.Name), "", string(data), opts, t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Name, err)
 		}
+		docs = append(docs, d...)
+	}
+	return docs, nil
+}
 
-	case "csv":
-		// and eventually if -c, csv files
-		fmt.Fprint(os.Stderr, "Sorry, .csv isn't implemented yet.")
-		return
+// join puts together the parts of a document's name, such as an
+// archive member and a HAR entry, either of which may be empty
+func join(outer, inner string) string {
+	if outer == "" || inner == "" {
+		return outer + inner
 	}
+	return outer + ": " + inner
 }
 
+// streamFile evaluates the expressions on a file as it's lexed from r,
+// reading only as much of it as it takes to find what they select, or
+// with first, the first thing each selects
+func streamFile(name, prefix string, f format.Format, r io.Reader, exprs []*pathExpr.Expr, first bool,
+	t trace.Trace) input {
+	var in = input{name: name}
+	var found func(int, pathExpr.Node) bool
 
+	defer t.Begin(name, f.Name, first)()
+	if first {
+		found = func(int, pathExpr.Node) bool { return false }
+	}
+	l := f.Start(context.Background(), r, t)
+	results, errs := pathExpr.StreamAll(exprs, l.Pipe, l.Stop, found, t)
+	if err := l.Err(); err != nil {
+		in.err = err
+		return in
+	}
+	in.docs = []evaluated{{document: document{name: prefix}, results: results, errs: errs}}
+	return in
+}
+
+// output is how results are printed: a line per element selected, or
+// with a format of json, one array of them all once they're known
+type output struct {
+	w       io.Writer
+	format  string
+	first   bool         // print only the first element selected
+	results []jsonResult // kept for the array
+}
+
+// jsonResult is an element selected, as printed by -o json
+type jsonResult struct {
+	Document   string `json:"document,omitempty"`
+	Expression string `json:"expression"`
+	Name       string `json:"name"`
+	Value      string `json:"value"`
+}
+
+// report prints what an expression selected in a document, and on stderr
+// any error or warnings about it. An expression that selected nothing
+// prints nothing, and its error says so.
+func (o *output) report(doc string, i int, e *pathExpr.Expr, r *pathExpr.Result, err error) {
+	var prefix string
+
+	if doc != "" {
+		prefix = doc + ": "
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(os.Stderr, "%s%d: warning, path expression %q %s\n", prefix, i, e, w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%d: %s\n", prefix, i, err)
+	}
+	nodes := r.Nodes
+	if o.first && len(nodes) > 1 {
+		nodes = nodes[:1]
+	}
+	for _, n := range nodes {
+		if o.format == "json" {
+			o.results = append(o.results, jsonResult{Document: doc, Expression: e.String(),
+				Name: n.Name, Value: n.Value})
+			continue
+		}
+		fmt.Fprintf(o.w, "%s%d: path expression %q selected %q\n", prefix, i, e, n.Value)
+	}
+}
+
+// flush prints the json array, if that's the format, which is empty
+// rather than null if nothing was selected
+func (o *output) flush() {
+	if o.format != "json" {
+		return
+	}
+	if o.results == nil {
+		o.results = []jsonResult{}
+	}
+	b, err := json.MarshalIndent(o.results, "", "  ")
+	if err != nil {
+		// can't happen with strings alone
+		panic(err)
+	}
+	fmt.Fprintf(o.w, "%s\n", b)
+}
 
-// evaluate applies the path expression to the tokenized inputs
+// evaluate compiles a path expression and applies it to the tokenized
+// inputs, reporting any error or warnings as jxpath does
 func evaluate(tokens []token.Token, pathExpression string, explain bool, t trace.Trace) string {
 	defer t.Begin(tokens, explain, t)()
 
+	e, err := pathExpr.Compile(pathExpression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return ""
+	}
+	if explain {
+		fmt.Fprintf(os.Stderr, "explanation: %s\n", e.Explain())
+	}
 	path := pathExpr.NewPath(tokens, t)
-	value := path.Interpreter(pathExpression, t, explain)
+	r, err := e.EvalTrace(path, t)
+	for _, w := range r.Warnings {
+		fmt.Fprintf(os.Stderr, "warning, path expression %q %s\n", e, w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
 
 	t.Printf("return path = %s\n", path)
-	t.Printf("return value = %s\n", value)
-	return value
+	t.Printf("return value = %s\n", r.Value)
+	return r.Value
 
 }
 
-// guessType guesses at the type of a file: xml and json are the only interesting ones,
-// and just maybe .csv
+// guessType guesses at the type of an input, as the first format that
+// recognizes it
 func guessType(s string, t trace.Trace) string {
 	defer t.Begin(s)()
-	if strings.Contains(s, "<?xml") || strings.Contains(s, "</") || strings.Contains(s, "/>") {
-		return "xml"
-	} else if strings.Contains(s, ":") || strings.Contains(s, "{") {
-		return "json"
-	} else if strings.Contains(s, ",") {
-		return "csv"
+	if f, ok := format.Detect(s, t); ok {
+		return f.Name
 	}
 	return "unguessed"
 }
@@ -3,13 +3,40 @@ package main
 import (
 	"token"
 	"trace"
+	"unpack"
 	xml_lexer "xml"
 	json_lexer "json"
+	"lexer"
+	"pathExpr"
+	"format"
+	"msgpack"
+	"cbor"
+	"xmlrpc"
+	"plist"
+	"soap"
+	"har"
 
 	"testing"
 	"os"
 	"io/ioutil"
-	"syscall"
+	"reflect"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"archive/tar"
+	"archive/zip"
+	"path/filepath"
+	"strings"
+	"fmt"
+	"io"
+	"errors"
+	"encoding/json"
+	"context"
+	"runtime"
+	"sync"
+	"time"
+	"regexp"
+	"testing/iotest"
 )
 
 var xmlInput =
@@ -185,15 +212,16 @@ func goodPathTests(t *testing.T, tokens []token.Token, tracer trace.Trace)  {
 		expect  string
 	} {
 		// regular success cases
-		{ expr: "/world", expect:"nada", },
 		{ expr: "//world", expect:"nada", },
-		{ expr: "/galaxy/world", expect:"nada", },
+		{ expr: "//galaxy/world", expect:"nada", },
 		{ expr: "/universe/galaxy/world", expect:"nada", },
+		{ expr: "/universe//world", expect:"nada", },
 		{ expr: `/universe/galaxy[world="earth"]`, expect: `earth  who`},
 		{ expr: `/universe/galaxy[world="earth"]/timelord`, expect: `who`},
-		{ expr: `/galaxy[2]/timelord`, expect:`who` },
+		{ expr: `//galaxy[2]/timelord`, expect:`who` },
 		{ expr: `/universe/galaxy[2]/timelord`, expect: `who`},
-		{ expr: `/universe/timelord[2]`, expect: `master`},
+		{ expr: `/universe/timelord`, expect: `master`},
+		{ expr: `//galaxy[world="earth"]//timelord`, expect: `who`},
 	}
 
 	tracer.Begin()()
@@ -238,6 +266,14 @@ func badPathTests(t *testing.T, tokens []token.Token, tracer trace.Trace)  {
 		{ expr: `/galaxy[1]/timelord`, expect: ``},
 		{ expr: `/universe/galaxy[3]/timelord`, expect: ``},
 		{ expr: `/galaxy[3]/timelord`, expect: ``},
+		// things that are there, but not where the path says
+		{ expr: "/world", expect: ``},
+		{ expr: "/galaxy/world", expect: ``},
+		{ expr: `/galaxy[2]/timelord`, expect: ``},
+		{ expr: `/universe/timelord[2]`, expect: ``},
+		{ expr: `/universe/world`, expect: ``},
+		// positions count in each parent, and no timelord is a second
+		{ expr: `//timelord[2]`, expect: ``},
 	}
 
 	// to run a test on the _messages_ instead, you need to not shut of stderr
@@ -256,8 +292,1863 @@ func badPathTests(t *testing.T, tokens []token.Token, tracer trace.Trace)  {
 }
 
 
-// devnull pretends to be a file, but does nothing
-// The notation is odd, but taken from the go implementation.
+// devnull is a file that takes what's written and does nothing with it
 func devNull() *os.File {
-	return os.NewFile(uintptr(syscall.Stdin), "/dev/null")
+	// a file of its own, as one made from stdin's descriptor closes it
+	// when it's collected, even if it's been reused, as by a pipe
+	f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return os.Stderr
+	}
+	return f
+}
+
+// A HAR archive with a json response and a base64-encoded xml one
+var harInput = `{"log": {"version": "1.2", "creator": {"name": "test"}, "entries": [` +
+	`{"request": {"method": "GET", "url": "http://example.com/a"},` +
+	` "response": {"status": 200, "content": {"mimeType": "application/json; charset=utf-8",` +
+	`  "text": "{\"universe\": {\"timelord\": \"master\"}}"}}},` +
+	`{"request": {"method": "GET", "url": "http://example.com/b"},` +
+	` "response": {"status": 302, "content": {"mimeType": "", "text": ""}}},` +
+	`{"request": {"method": "GET", "url": "http://example.com/c"},` +
+	` "response": {"status": 200, "content": {"mimeType": "text/xml", "encoding": "base64",` +
+	`  "text": "PHVuaXZlcnNlPjx0aW1lbG9yZD53aG88L3RpbWVsb3JkPjwvdW5pdmVyc2U+"}}}` +
+	`]}}`
+
+func TestHar(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	if guessType(harInput, tracer) != "har" {
+		t.Errorf("guessType did not recognize a HAR archive\n")
+	}
+	// json that only mentions what a HAR file has is json
+	for _, input := range []string{
+		`{"event": "upload", "log": "saved", "entries": 3, "creator": "rose"}`,
+		`{"log": {"entries": "none", "version": "1.2", "creator": {"name": "test"}}}`,
+		`{"log": {"entries": [], "creator": {"name": "test"}}}`,
+		`[{"log": {"version": "1.2", "entries": []}}]`,
+	} {
+		if guessed := guessType(input, tracer); guessed != "json" {
+			t.Errorf("expected %s to be json, guessed %s\n", input, guessed)
+		}
+	}
+	if guessed := guessType(`{"log": {"version": "1.2", "entries": []}}`, tracer); guessed != "har" {
+		t.Errorf("expected a HAR file without a creator to be recognized, guessed %s\n", guessed)
+	}
+	// the start of one is, once it's shown its log has a version and entries
+	for n := strings.Index(harInput, "[") + 1; n < len(harInput); n += 7 {
+		if !har.IsHAR(harInput[:n]) {
+			t.Errorf("expected the first %d bytes of a HAR file to be one\n", n)
+		}
+	}
+	if har.IsHAR(harInput[:strings.Index(harInput, "[")]) || har.IsHAR(harInput + "{}") {
+		t.Errorf("expected a HAR file without its entries, or with more after it, not to be one\n")
+	}
+	docs, err := documents("", "har", harInput, nil, tracer)
+	if err != nil {
+		t.Fatalf("documents failed, %v\n", err)
+	}
+	var tests = []struct {
+		name   string
+		expect string
+	}{
+		{ name: "entries[0] http://example.com/a", expect: "master"},
+		{ name: "entries[2] http://example.com/c", expect: "who"},
+	}
+	if len(docs) != len(tests) {
+		t.Fatalf("expected %d documents, got %d\n", len(tests), len(docs))
+	}
+	for i, test := range tests {
+		value := evaluate(docs[i].tokens, "/universe/timelord", false, tracer)
+		if docs[i].name != test.name || value != test.expect {
+			t.Errorf("%d: { name:%q, expect:%q }, got %q, %q\n",
+				i, test.name, test.expect, docs[i].name, value)
+		}
+	}
+}
+
+// The same document in json, msgpack and cbor, the last with cbor's magic number
+var binaryJson = `{"universe": {"galaxy": [{"world": "nada"}, {"world": ["earth", ""], "timelord": "who"}], ` +
+	`"timelord": "master", "moons": -300, "dark": null, "matter": true, "blob": "AAEC"}}`
+var msgpackInput = "\x81\xa8universe\x86\xa6galaxy\x92\x81\xa5world\xa4nada\x82\xa5world\x92\xa5earth" +
+	"\xa0\xa8timelord\xa3who\xa8timelord\xa6master\xa5moons\xd1\xfe\xd4\xa4dark\xc0\xa6matter\xc3" +
+	"\xa4blob\xc4\x03\x00\x01\x02"
+var cborInput = "\xd9\xd9\xf7\xa1huniverse\xa6fgalaxy\x82\xa1eworlddnada\xa2eworld\x82eearth`htimelordcwho" +
+	"htimelordfmasteremoons9\x01+ddark\xf6fmatter\xf5dblobC\x00\x01\x02"
+
+func TestBinary(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var expect = json_lexer.Lex(binaryJson, tracer)
+	var tests = []struct {
+		name   string
+		input  string
+		tokens []token.Token
+	}{
+		{ name: "msgpack", input: msgpackInput, tokens: msgpack.Lex(msgpackInput, tracer)},
+		{ name: "cbor", input: cborInput, tokens: cbor.Lex(cborInput, tracer)},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.tokens, expect) {
+			t.Errorf("%d: %s got %v, expected %v\n", i, test.name, test.tokens, expect)
+		}
+		if guessed := guessType(test.input, tracer); guessed != test.name {
+			t.Errorf("%d: guessed %s, expected %s\n", i, guessed, test.name)
+		}
+		if value := evaluate(test.tokens, "/universe/galaxy[2]/timelord", false, tracer); value != "who" {
+			t.Errorf("%d: %s got %q, expected \"who\"\n", i, test.name, value)
+		}
+	}
+	// without the magic number, cbor is detected by being valid
+	if guessed := guessType(cborInput[len(cbor.Magic):], tracer); guessed != "cbor" {
+		t.Errorf("guessed %s for cbor without magic\n", guessed)
+	}
+	// arrays nested deeper than the decoders go are an error, not a crash
+	var deep = []struct {
+		name  string
+		array string
+		valid func(string) bool
+		lex   func(string, trace.Trace) []token.Token
+	}{
+		{ name: "msgpack", array: "\x91", valid: msgpack.Valid, lex: msgpack.Lex},
+		{ name: "cbor", array: "\x81", valid: cbor.Valid, lex: cbor.Lex},
+	}
+	for i, test := range deep {
+		if !test.valid(strings.Repeat(test.array, lexer.MaxDepth) + "\x01") {
+			t.Errorf("%d: %s arrays %d deep weren't valid\n", i, test.name, lexer.MaxDepth)
+		}
+		input := strings.Repeat(test.array, 100000) + "\x01"
+		if test.valid(input) {
+			t.Errorf("%d: %s arrays 100000 deep were valid\n", i, test.name)
+		}
+		tokens := test.lex(input, tracer)
+		if last := tokens[len(tokens)-1]; last.Typ != token.ERROR || !strings.Contains(last.Val, "nested") {
+			t.Errorf("%d: %s arrays 100000 deep ended with %v\n", i, test.name, last)
+		}
+		if guessed := guessType(input, tracer); guessed == test.name {
+			t.Errorf("%d: guessed %s for arrays 100000 deep\n", i, guessed)
+		}
+	}
+}
+
+// Log lines, with json and xml embedded in them
+var logInput = `2026-10-01T12:00:00Z INFO handler {"user": {"id": 1, "name": "who"}}` + "\n" +
+	`2026-10-01T12:00:01Z [WARN] nothing to see here` + "\n" +
+	`2026-10-01T12:00:02Z INFO handler [{"user": {"id": 2}}] and <user><id>3</id></user>`
+
+func TestLogs(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var tests = []struct {
+		withXML bool
+		names   []string
+		expect  []string
+	}{
+		{ withXML: false, names: []string{"line 1", "line 3"}, expect: []string{"1", "2"}},
+		{ withXML: true, names: []string{"line 1", "line 3", "line 3"}, expect: []string{"1", "2", "3"}},
+	}
+	for i, test := range tests {
+		docs, _ := documents("", "logs", logInput, format.Options{"logxml": fmt.Sprint(test.withXML)}, tracer)
+		if len(docs) != len(test.names) {
+			t.Errorf("%d: expected %d documents, got %d\n", i, len(test.names), len(docs))
+			continue
+		}
+		for j, d := range docs {
+			value := evaluate(d.tokens, "/user/id", false, tracer)
+			if d.name != test.names[j] || value != test.expect[j] {
+				t.Errorf("%d.%d: { name:%q, expect:%q }, got %q, %q\n",
+					i, j, test.names[j], test.expect[j], d.name, value)
+			}
+		}
+	}
+}
+
+// Documents embedded, escaped, in string values
+func TestParse(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var jsonTokens = json_lexer.Lex(`{"event": {"payload": "{\"id\": 1, \"who\": \"the doctor\"}", ` +
+		`"soap": "<Envelope><Body><id>2</id></Body></Envelope>"}}`, tracer)
+	var xmlTokens = xml_lexer.Lex(`<event><payload>{&quot;id&quot;: 3}</payload>` +
+		`<soap>&lt;Body&gt;&lt;id&gt;4&lt;/id&gt;&lt;/Body&gt;</soap></event>`, tracer)
+	var tests = []struct {
+		tokens []token.Token
+		expr   string
+		expect string
+	}{
+		{ tokens: jsonTokens, expr: "/event/payload/parse()/id", expect: "1"},
+		{ tokens: jsonTokens, expr: "/event/payload/parse(json)/who", expect: "the doctor"},
+		{ tokens: jsonTokens, expr: "/event/soap/parse()/Envelope/Body/id", expect: "2"},
+		{ tokens: xmlTokens, expr: "/event/payload/parse()/id", expect: "3"},
+		{ tokens: xmlTokens, expr: "/event/soap/parse(xml)/Body/id", expect: "4"},
+	}
+	for i, test := range tests {
+		value := evaluate(test.tokens, test.expr, false, tracer)
+		if value != test.expect {
+			t.Errorf("%d: { expr:%q, expect:%q }, get %q\n",
+				i, test.expr, test.expect, value)
+		}
+	}
+}
+
+// An xml-rpc response and a property list, each holding the same values
+var xmlrpcInput = `<?xml version="1.0"?>
+<methodResponse><params><param><value><struct>
+  <member><name>id</name><value><int>3</int></value></member>
+  <member><name>active</name><value><boolean>1</boolean></value></member>
+  <member><name>tags</name><value><array><data>
+    <value><string>tardis</string></value>
+    <value>police box</value>
+  </data></array></value></member>
+  <member><name>master</name><value><nil/></value></member>
+</struct></value></param></params></methodResponse>`
+
+var plistInput = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+  <key>id</key><integer>3</integer>
+  <key>active</key><true/>
+  <key>tags</key><array><string>tardis</string><string>police box</string></array>
+  <key>master</key><string>null</string>
+</dict>
+</plist>`
+
+func TestXmlrpcAndPlist(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var expect = json_lexer.Lex(`{"id": 3, "active": true, "tags": ["tardis", "police box"], "master": null}`, tracer)
+	var tests = []struct {
+		name   string
+		input  string
+		tokens []token.Token
+	}{
+		{ name: "xmlrpc", input: xmlrpcInput, tokens: xmlrpc.Lex(xmlrpcInput, tracer)},
+		{ name: "plist", input: plistInput, tokens: plist.Lex(plistInput, tracer)},
+	}
+	for i, test := range tests {
+		if !reflect.DeepEqual(test.tokens, expect) {
+			t.Errorf("%d: %s got %v, expected %v\n", i, test.name, test.tokens, expect)
+		}
+		if guessed := guessType(test.input, tracer); guessed != test.name {
+			t.Errorf("%d: guessed %s, expected %s\n", i, guessed, test.name)
+		}
+		if value := evaluate(test.tokens, "/tags[2]", false, tracer); value != "police box" {
+			t.Errorf("%d: %s got %q, expected \"police box\"\n", i, test.name, value)
+		}
+	}
+
+	// nested and empty arrays and maps are decoded as json's are, and
+	// a value's type is lost, as it is in json
+	expect = json_lexer.Lex(`{"a": [[1, "2"], []], "d": {}}`, tracer)
+	var nested = []struct {
+		name   string
+		tokens []token.Token
+	}{
+		{ name: "xmlrpc", tokens: xmlrpc.Lex(`<methodResponse><params><param><value><struct>` +
+			`<member><name>a</name><value><array><data>` +
+			`<value><array><data><value><int>1</int></value><value><string>2</string></value></data></array></value>` +
+			`<value><array><data/></array></value></data></array></value></member>` +
+			`<member><name>d</name><value><struct/></value></member>` +
+			`</struct></value></param></params></methodResponse>`, tracer)},
+		{ name: "plist", tokens: plist.Lex(`<plist version="1.0"><dict><key>a</key><array>` +
+			`<array><integer>1</integer><string>2</string></array><array/></array>` +
+			`<key>d</key><dict/></dict></plist>`, tracer)},
+	}
+	for i, test := range nested {
+		if !reflect.DeepEqual(test.tokens, expect) {
+			t.Errorf("%d: %s got %v, expected %v\n", i, test.name, test.tokens, expect)
+		}
+	}
+
+	// faults are named, and calls have their parameters in an array
+	var fault = xmlrpc.Lex(`<methodResponse><fault><value><struct><member><name>faultCode</name>` +
+		`<value><int>4</int></value></member></struct></value></fault></methodResponse>`, tracer)
+	if value := evaluate(fault, "/fault/faultCode", false, tracer); value != "4" {
+		t.Errorf("fault got %q, expected \"4\"\n", value)
+	}
+	var call = xmlrpc.Lex(`<methodCall><methodName>who</methodName><params>` +
+		`<param><value><i4>1</i4></value></param><param><value><i4>2</i4></value></param>` +
+		`</params></methodCall>`, tracer)
+	if value := evaluate(call, "/params[2]", false, tracer); value != "2" {
+		t.Errorf("call got %q, expected \"2\"\n", value)
+	}
+}
+
+// SOAP 1.1 and 1.2 envelopes, with a payload and with faults
+func TestSoap(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var tests = []struct {
+		input  string
+		expr   string
+		expect string
+		fault  *soap.Fault
+	}{
+		{ input: `<?xml version="1.0"?><soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Header><m:Trans>1</m:Trans></soap:Header><soap:Body xmlns:m="http://example.org/stock">` +
+			`<m:GetPriceResponse><m:Price>34.5</m:Price></m:GetPriceResponse></soap:Body></soap:Envelope>`,
+			expr: "/GetPriceResponse/Price", expect: "34.5"},
+		{ input: `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+			`<soap:Fault><faultcode>soap:Server</faultcode><faultstring>Out of time</faultstring>` +
+			`<detail><e>Gallifrey</e></detail></soap:Fault></soap:Body></soap:Envelope>`,
+			expr: "/Fault/faultstring", expect: "Out of time",
+			fault: &soap.Fault{Version: "1.1", Code: "soap:Server", String: "Out of time", Detail: "Gallifrey"}},
+		{ input: `<env:Envelope xmlns:env="http://www.w3.org/2003/05/soap-envelope"><env:Body><env:Fault>` +
+			`<env:Code><env:Value>env:Sender</env:Value></env:Code>` +
+			`<env:Reason><env:Text xml:lang="en">Bad TARDIS</env:Text></env:Reason>` +
+			`</env:Fault></env:Body></env:Envelope>`,
+			expr: "/Fault/Code/Value", expect: "env:Sender",
+			fault: &soap.Fault{Version: "1.2", Code: "env:Sender", String: "Bad TARDIS"}},
+		// attributes on the Body aren't the payload, and don't hide a fault
+		{ input: `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Body soap:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/" id="b">` +
+			`<soap:Fault><faultcode>soap:Client</faultcode><faultstring>No such world</faultstring>` +
+			`</soap:Fault></soap:Body></soap:Envelope>`,
+			expr: "/Fault/faultcode", expect: "soap:Client",
+			fault: &soap.Fault{Version: "1.1", Code: "soap:Client", String: "No such world"}},
+		{ input: `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Body soap:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><price>34.5</price></soap:Body></soap:Envelope>`,
+			expr: "/encodingStyle", expect: ""},
+		// whatever else looks like a Body, or like attributes in it
+		{ input: `<!-- <soap:Body a="1" b="2"> --><soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Bodyguard/><soap:Body id="a=b"><soap:Fault><faultcode>soap:Client</faultcode>` +
+			`<faultstring>No such world</faultstring></soap:Fault></soap:Body></soap:Envelope>`,
+			expr: "/Fault/faultstring", expect: "No such world",
+			fault: &soap.Fault{Version: "1.1", Code: "soap:Client", String: "No such world"}},
+		// nor is a Fault in some other namespace a SOAP fault
+		{ input: `<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body>` +
+			`<app:Fault xmlns:app="http://example.org/app"><reason>tyre</reason></app:Fault></soap:Body></soap:Envelope>`,
+			expr: "/Fault/reason", expect: "tyre"},
+	}
+	for i, test := range tests {
+		if guessed := guessType(test.input, tracer); guessed != "soap" {
+			t.Errorf("%d: guessed %s, expected soap\n", i, guessed)
+		}
+		tokens, err := soap.Lex(test.input, tracer)
+		if fault, _ := err.(*soap.Fault); !reflect.DeepEqual(fault, test.fault) {
+			t.Errorf("%d: got fault %v, expected %v\n", i, err, test.fault)
+		}
+		value := evaluate(tokens, test.expr, false, tracer)
+		if value != test.expect {
+			t.Errorf("%d: { expr:%q, expect:%q }, get %q\n",
+				i, test.expr, test.expect, value)
+		}
+	}
+}
+
+// Compressed input, decompressed before it is lexed
+func TestDecompress(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var plain = "<universe><timelord>master</timelord></universe>"
+	var gz, zl bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(plain))
+	w.Close()
+	z := zlib.NewWriter(&zl)
+	z.Write([]byte(plain))
+	z.Close()
+
+	var tests = []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{ name: "gzip", input: gz.String(), expect: plain},
+		{ name: "zlib", input: zl.String(), expect: plain},
+		{ name: "bzip2", input: "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\xdd\x00\x49\x98\x00\x00" +
+			"\x02\x99\x80\x00\x00\x80\x05\x26\x27\x9f\x00\x20\x00\x21\x2a\x7a\x80\x0d\x1e\xa1" +
+			"\x4c\x00\x13\x44\x72\x92\xb5\xc5\xaa\x90\x4c\xeb\x11\xd3\x06\x60\x67\x8a\xb1\x1c" +
+			"\x1c\x36\x2d\x1f\x17\x72\x45\x38\x50\x90\xdd\x00\x49\x98", expect: plain},
+		{ name: "plain", input: plain, expect: plain},
+		{ name: "text that looks like zlib", input: "x^2", expect: "x^2"},
+		{ name: "text with a zlib header", input: "x marks the spot", expect: "x marks the spot"},
+		{ name: "more text than a trial", input: "x^" + strings.Repeat("y = 2x ", 100),
+			expect: "x^" + strings.Repeat("y = 2x ", 100)},
+	}
+	for i, test := range tests {
+		source, err := readInput(bytes.NewReader([]byte(test.input)))
+		if err != nil || source != test.expect {
+			t.Errorf("%d: %s got %q, %v\n", i, test.name, source, err)
+			continue
+		}
+		r, err := decompressReader(strings.NewReader(test.input))
+		if err == nil {
+			var streamed []byte
+			streamed, err = ioutil.ReadAll(r)
+			source = string(streamed)
+		}
+		if err != nil || source != test.expect {
+			t.Errorf("%d: %s streamed %q, %v\n", i, test.name, source, err)
+			continue
+		}
+		if test.expect != plain {
+			continue
+		}
+		docs, _ := documents("", "", source, nil, tracer)
+		if len(docs) != 1 {
+			t.Errorf("%d: %s gave %d documents\n", i, test.name, len(docs))
+			continue
+		}
+		if value := evaluate(docs[0].tokens, "/universe/timelord", false, tracer); value != "master" {
+			t.Errorf("%d: %s selected %q\n", i, test.name, value)
+		}
+	}
+}
+
+// Zip and tar archives, whose members are each a document
+func TestArchives(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`{"timelord": "rani"}`))
+	w.Close()
+	var members = []struct {
+		name string
+		data string
+	}{
+		{ name: "a/universe.xml", data: xmlInput},
+		{ name: "b.json", data: `{"timelord": "master"}`},
+		{ name: "c.json.gz", data: gz.String()},
+		{ name: "README", data: "nothing to see here"},
+	}
+
+	var zipped, tarred bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	tw := tar.NewWriter(&tarred)
+	for _, m := range members {
+		f, _ := zw.Create(m.name)
+		f.Write([]byte(m.data))
+		tw.WriteHeader(&tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data))})
+		tw.Write([]byte(m.data))
+	}
+	zw.Close()
+	tw.Close()
+
+	var tests = []struct {
+		input  string
+		glob   string
+		names  []string
+		expect []string
+	}{
+		{ input: zipped.String(), names: []string{"a/universe.xml", "b.json", "c.json.gz"},
+			expect: []string{"who", "master", "rani"}},
+		{ input: tarred.String(), names: []string{"a/universe.xml", "b.json", "c.json.gz"},
+			expect: []string{"who", "master", "rani"}},
+		{ input: tarred.String(), glob: "*.json", names: []string{"b.json"},
+			expect: []string{"master"}},
+	}
+	for i, test := range tests {
+		docs, err := documents("", "", test.input, format.Options{"members": test.glob}, tracer)
+		if err != nil || len(docs) != len(test.names) {
+			t.Errorf("%d: expected %d documents, got %d, %v\n", i, len(test.names), len(docs), err)
+			continue
+		}
+		for j, d := range docs {
+			value := evaluate(d.tokens, "//timelord", false, tracer)
+			if d.name != test.names[j] || value != test.expect[j] {
+				t.Errorf("%d.%d: { name:%q, expect:%q }, got %q, %q\n",
+					i, j, test.names[j], test.expect[j], d.name, value)
+			}
+		}
+	}
+
+	// a member that inflates past the limit is an error, not all of memory
+	var bomb bytes.Buffer
+	zw = zip.NewWriter(&bomb)
+	f, _ := zw.Create("zeros.json")
+	f.Write(make([]byte, 1<<20))
+	zw.Close()
+	defer func(max int64) { unpack.MaxMember = max }(unpack.MaxMember)
+	unpack.MaxMember = 1 << 16
+	if _, err := unpack.Members(bomb.String(), "", tracer); err == nil || !strings.Contains(err.Error(), "zeros.json: bigger") {
+		t.Errorf("expected a member too big to read, got %v\n", err)
+	}
+}
+
+// Test splitting path expressions from file names, and reading the files
+func TestFileArgs(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+	var tests = []struct {
+		args        []string
+		files       []string
+		expressions []string
+		names       []string
+	}{
+		{ args: []string{"/a", "/b"}, expressions: []string{"/a", "/b"}},
+		{ args: []string{"/a", "--", "x.json", "y.xml"}, expressions: []string{"/a"},
+			names: []string{"x.json", "y.xml"}},
+		{ args: []string{"/a", "--", "y.xml"}, files: []string{"x.json"},
+			expressions: []string{"/a"}, names: []string{"x.json", "y.xml"}},
+		{ args: []string{"--", "x.json"}, names: []string{"x.json"}},
+	}
+	for i, test := range tests {
+		expressions, names := splitArgs(test.args, test.files)
+		if len(expressions) != len(test.expressions) || len(names) != len(test.names) ||
+			strings.Join(expressions, " ") != strings.Join(test.expressions, " ") ||
+			strings.Join(names, " ") != strings.Join(test.names, " ") {
+			t.Errorf("%d: expected %q and %q, got %q and %q\n",
+				i, test.expressions, test.names, expressions, names)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "jxpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputs := map[string]string{
+		"a.xml":  "<timelord>who</timelord>",
+		"b.json": `{"timelord": "master"}`,
+	}
+	for name, data := range inputs {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+	for name, expect := range map[string]string{"a.xml": "who", "b.json": "master"} {
+		source, err := readFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("%s: %v\n", name, err)
+			continue
+		}
+		docs, err := documents(name, "", source, nil, tracer)
+		if err != nil || len(docs) != 1 || docs[0].prefix() != name+": " {
+			t.Errorf("%s: expected one document named %q, got %v, %v\n", name, name, docs, err)
+			continue
+		}
+		if value := evaluate(docs[0].tokens, "/timelord", false, tracer); value != expect {
+			t.Errorf("%s: expected %q, got %q\n", name, expect, value)
+		}
+	}
+	if _, err := readFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("expected an error reading a missing file\n")
+	}
+}
+
+// Pipes, files and /dev/null are read, terminals aren't, even though a
+// pipe's size is zero
+func TestStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if isTerminal(r) {
+		t.Errorf("expected a pipe not to be a terminal\n")
+	}
+	go func() {
+		w.Write([]byte(`{"timelord": "who"}`))
+		w.Close()
+	}()
+	stdin := os.Stdin
+	os.Stdin = r
+	source, err := readFile("-")
+	os.Stdin = stdin
+	if err != nil || source != `{"timelord": "who"}` {
+		t.Errorf("expected to read the whole pipe, got %q, %v\n", source, err)
+	}
+	if null, err := os.Open(os.DevNull); err == nil {
+		if isTerminal(null) {
+			t.Errorf("expected %s, a character device, not to be a terminal\n", os.DevNull)
+		}
+		null.Close()
+	}
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		if !isTerminal(tty) {
+			t.Errorf("expected /dev/tty to be a terminal\n")
+		}
+		tty.Close()
+	}
+	if displayName("-") != "(standard input)" || displayName("a.json") != "a.json" {
+		t.Errorf("expected stdin to be named (standard input)\n")
+	}
+}
+
+// Walk a directory tree, and lex and evaluate its files in parallel but
+// report them in order
+func TestDirectories(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	exprs := []*pathExpr.Expr{pathExpr.MustCompile("/order/total")}
+
+	dir, err := ioutil.TempDir("", "jxpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inputs := map[string]string{
+		"b/c.json":    `{"order": {"total": "3"}}`,
+		"a.json":      `{"order": {"total": "1"}}`,
+		"b/a.xml":     "<order><total>2</total></order>",
+		"b/notes.txt": "not an order",
+		".git/d.json": `{"order": {"total": "4"}}`,
+	}
+	for name, data := range inputs {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+	}
+
+	var tests = []struct {
+		glob   string
+		names  []string
+		expect []string
+	}{
+		{ glob: "*.json", names: []string{"a.json", "b/c.json"}, expect: []string{"1", "3"}},
+		{ glob: "*.[jx]*", names: []string{"a.json", "b/a.xml", "b/c.json"}, expect: []string{"1", "2", "3"}},
+		{ names: []string{"a.json", "b/a.xml", "b/c.json", "b/notes.txt"}},
+	}
+	for i, test := range tests {
+		names, err := walkFiles(dir, test.glob)
+		if err != nil || len(names) != len(test.names) {
+			t.Errorf("%d: expected %q, got %q, %v\n", i, test.names, names, err)
+			continue
+		}
+		for j, name := range names {
+			if name != filepath.Join(dir, test.names[j]) {
+				t.Errorf("%d.%d: expected %q, got %q\n", i, j, test.names[j], name)
+			}
+		}
+		if test.expect == nil {
+			continue
+		}
+		var j int
+		for in := range evalFiles(names, true, "", nil, exprs, false, 2, tracer) {
+			if in.err != nil || len(in.docs) != 1 || in.docs[0].name != names[j] {
+				t.Errorf("%d.%d: expected one document named %q, got %v\n", i, j, names[j], in)
+			} else if value := in.docs[0].results[0].Value; value != test.expect[j] {
+				t.Errorf("%d.%d: expected %q, got %q\n", i, j, test.expect[j], value)
+			}
+			j++
+		}
+		if j != len(names) {
+			t.Errorf("%d: expected %d files, got %d\n", i, len(names), j)
+		}
+	}
+
+	// however many there are, they come out in order, each as soon as
+	// it's ready
+	var many []string
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("many/%02d.json", i))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		ioutil.WriteFile(name, []byte(fmt.Sprintf(`{"order": {"total": "%d"}}`, i)), 0644)
+		many = append(many, name)
+	}
+	var j int
+	for in := range evalFiles(many, true, "", nil, exprs, false, 4, tracer) {
+		if expect := fmt.Sprint(j); in.name != many[j] || in.err != nil || in.docs[0].results[0].Value != expect {
+			t.Errorf("%d: expected %s with %q, got %s, %v\n", j, many[j], expect, in.name, in.err)
+		}
+		j++
+	}
+	if _, err := walkFiles(dir, "["); err == nil {
+		t.Errorf("expected an error for a bad pattern\n")
+	}
+}
+
+// A file is read once, as it's decompressed: its type is guessed from its
+// start, and if it can be it's streamed, or if not read whole and guessed
+// again
+func TestEvalFile(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	dir, err := ioutil.TempDir("", "jxpath")
+	if err != nil {
+		t.Fatalf("couldn't make a directory, %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// bigger than what's guessed from
+	var orders bytes.Buffer
+	orders.WriteString(`{"orders": [`)
+	for i := 0; orders.Len() < 2*sniff; i++ {
+		fmt.Fprintf(&orders, `{"id": %d}, `, i)
+	}
+	orders.WriteString(`{"end": "last"}]}`)
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(orders.Bytes())
+	zw.Close()
+
+	// a HAR file whose entries go on past it
+	var entries bytes.Buffer
+	entries.WriteString(`{"log": {"version": "1.2", "entries": [`)
+	for i := 0; entries.Len() < 2*sniff; i++ {
+		fmt.Fprintf(&entries, `{"request": {"url": "http://example.com/%d"}, "response": {"content":`+
+			` {"mimeType": "application/json", "text": "{\"id\": %d}"}}}, `, i, i)
+	}
+	entries.WriteString(`{"request": {"url": "http://example.com/last"}, "response": {"content":` +
+		` {"mimeType": "application/json", "text": "{\"id\": \"last\"}"}}}]}}`)
+
+	// with a character cut in two at the end of what's guessed from
+	var cut bytes.Buffer
+	cut.WriteString(`<orders>`)
+	for cut.Len() < sniff-len(`<id>`)-1 {
+		cut.WriteString(" ")
+	}
+	cut.WriteString(`<id>é</id><id>last</id></orders>`)
+
+	var tests = []struct {
+		name   string
+		data   []byte
+		expr   string
+		docs   int
+		expect string
+	}{
+		{ name: "orders.json.gz", data: zipped.Bytes(), expr: "/orders/end", docs: 1, expect: "last"},
+		{ name: "har.json", data: entries.Bytes(), expr: "/id", docs: strings.Count(entries.String(), "request"),
+			expect: "last"},
+		{ name: "cut.xml", data: cut.Bytes(), expr: "/orders/id[2]", docs: 1, expect: "last"},
+		{ name: "msgpack", data: []byte(msgpackInput), expr: "/universe/timelord", docs: 1, expect: "master"},
+		{ name: "soap.xml", data: []byte(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">` +
+			`<soap:Body><soap:Fault><faultcode>soap:Server</faultcode><faultstring>Out of time</faultstring>` +
+			`</soap:Fault></soap:Body></soap:Envelope>`), expr: "/Fault/faultstring", docs: 1, expect: "Out of time"},
+	}
+	for i, test := range tests {
+		name := filepath.Join(dir, test.name)
+		ioutil.WriteFile(name, test.data, 0644)
+		in := evalFile(name, false, "", nil, []*pathExpr.Expr{pathExpr.MustCompile(test.expr)}, false, tracer)
+		if in.err != nil || len(in.docs) != test.docs {
+			t.Errorf("%d: %s expected %d documents, got %d, %v\n", i, test.name, test.docs, len(in.docs), in.err)
+			continue
+		}
+		last := in.docs[len(in.docs)-1]
+		if r := last.results[0]; r.Value != test.expect || (test.name == "soap.xml") != (last.fault != nil) {
+			t.Errorf("%d: %s expected %q, got %q, %v\n", i, test.name, test.expect, r.Value, last.fault)
+		}
+	}
+}
+
+// Lexing from a reader, a byte at a time, gives the same tokens as lexing
+// a string, and a reader that fails gives an error
+func TestReaders(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	// big enough that the buffer has to slide many times
+	var big bytes.Buffer
+	big.WriteString(` {"orders": [`)
+	for i := 0; i < 5000; i++ {
+		if i > 0 {
+			big.WriteString(", ")
+		}
+		fmt.Fprintf(&big, `{"id": %d, "note": "café ☃ %d"}`, i, i)
+	}
+	big.WriteString("]}\n")
+
+	var tests = []struct {
+		name   string
+		input  string
+		lex    func(string, trace.Trace) []token.Token
+		start  func(context.Context, io.Reader, trace.Trace) *lexer.Lexer
+	}{
+		{ name: "xml", input: "\n  " + xmlInput + "\n", lex: xml_lexer.Lex, start: xml_lexer.Start},
+		{ name: "json", input: jsonInput, lex: json_lexer.Lex, start: json_lexer.Start},
+		{ name: "big json", input: big.String(), lex: json_lexer.Lex, start: json_lexer.Start},
+		{ name: "doctype", input: `<!DOCTYPE a [<!ENTITY x "y">]><a>b</a>`,
+			lex: xml_lexer.Lex, start: xml_lexer.Start},
+	}
+	for _, test := range tests {
+		expect := test.lex(test.input, tracer)
+		got := test.start(context.Background(), iotest.OneByteReader(strings.NewReader(test.input)), tracer).Tokens()
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("%s: reading a byte at a time gave different tokens\n", test.name)
+		}
+		if expect[len(expect)-1].Typ != token.EOF {
+			t.Errorf("%s: expected to end with EOF, got %v\n", test.name, expect[len(expect)-1])
+		}
+	}
+	tokens := json_lexer.Start(context.Background(), strings.NewReader(big.String()), tracer).Tokens()
+	if value := evaluate(tokens, "/orders[4999]/id", false, tracer); value != "4998" {
+		t.Errorf("expected %q, got %q\n", "4998", value)
+	}
+
+	failing := io.MultiReader(strings.NewReader(`{"a": "b`), iotest.ErrReader(errors.New("disk on fire")))
+	tokens = json_lexer.Start(context.Background(), failing, tracer).Tokens()
+	if last := tokens[len(tokens)-1]; last.Typ != token.ERROR || last.Val != "disk on fire" {
+		t.Errorf("expected the reader's error, got %v\n", last)
+	}
+
+	// which can be asked for while the lexer is still reading; run with
+	// -race to see it's safe to
+	failing = io.MultiReader(strings.NewReader(`{"a": "b`), iotest.ErrReader(errors.New("disk on fire")))
+	l := json_lexer.Start(context.Background(), failing, tracer)
+	l.Err()
+	for range l.Pipe {
+	}
+	if err := l.Err(); err == nil || err.Error() != "disk on fire" {
+		t.Errorf("expected the reader's error, got %v\n", err)
+	}
+}
+
+// counter counts the bytes read through it
+type counter struct {
+	r io.Reader
+	n int
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// Streaming gives the same answers as evaluating the whole document,
+// but stops reading once nothing more can be selected, or once it has
+// all that's wanted
+func TestStream(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var first = func(pathExpr.Node) bool { return false } // wants no more than the first
+	var exprs = []string{ "/world", "//world", "/galaxy/world", "/universe/galaxy/world",
+		`/universe/galaxy[world="earth"]`, `/universe/galaxy[world="earth"]/timelord`,
+		`/galaxy[2]/timelord`, `/universe/galaxy[2]/timelord`, `/universe/timelord[2]`,
+		`/galaxy[world="venus"]/timelord`, `/galaxy[1]/timelord`, `/galaxy[3]/timelord`,
+	}
+	// elements within elements of the same name, which the anchor
+	// decides from the inside out, and steps that go up or along
+	var nested = `<a><item><k>1</k><item><k>1</k></item></item><item><k>2</k></item>` +
+		`<b><item><k>1</k></item><item><k>3</k></item></b></a>`
+	var nestedExprs = []string{ `//item[k="1"]`, `//item[k="1"][2]`, `//item[2]`, `//item[2]/k`,
+		`/a/item[k="2"]/k`, `//item/k`, `/a/*[1]`, `//item[k="1"]/..`, `/a/item[1]/following-sibling::item`,
+		`/a/b/item/parent::b`, `//k/ancestor::item`, `/a/item[k="1"]/item/k`, `/a/item/self::item[k="2"]`,
+		`/`, `//item[k!="1"]`, `/nope`, `/a/nope/k`, `/a/item[3]`, `//b/item[k>1]`, `/a/item/item/parse()`,
+	}
+	var x *os.File
+	x, os.Stderr = os.Stderr, devNull()
+	for _, input := range []struct {
+		name  string
+		text  string
+		exprs []string
+		lex   func(string, trace.Trace) []token.Token
+		start func(context.Context, io.Reader, trace.Trace) *lexer.Lexer
+	}{
+		{ name: "xml", text: xmlInput, exprs: exprs, lex: xml_lexer.Lex, start: xml_lexer.Start},
+		{ name: "json", text: jsonInput, exprs: exprs, lex: json_lexer.Lex, start: json_lexer.Start},
+		{ name: "nested", text: nested, exprs: nestedExprs, lex: xml_lexer.Lex, start: xml_lexer.Start},
+	} {
+		path := pathExpr.NewPath(input.lex(input.text, tracer), tracer)
+		for i, expr := range input.exprs {
+			expect, expectErr := pathExpr.MustCompile(expr).EvalTrace(path, tracer)
+			l := input.start(context.Background(), strings.NewReader(input.text), tracer)
+			r, err := pathExpr.Stream(l.Pipe, expr, l.Stop, nil, tracer)
+			if !reflect.DeepEqual(nodeValues(r), nodeValues(expect)) || fmt.Sprint(err) != fmt.Sprint(expectErr) ||
+				len(r.Warnings) != len(expect.Warnings) {
+				t.Errorf("%s %d: { expr:%q, expect:%q, %v }, got %q, %v\n", input.name, i, expr,
+					nodeValues(expect), expectErr, nodeValues(r), err)
+			}
+		}
+	}
+	os.Stderr = x
+
+	// several at once, each passing on what it selects as it's read
+	var got []string
+	l := xml_lexer.Start(context.Background(), strings.NewReader(nested), tracer)
+	results, errs := pathExpr.StreamAll([]*pathExpr.Expr{pathExpr.MustCompile("//k"), pathExpr.MustCompile(`/a/b/item[2]`),
+		pathExpr.MustCompile("/a/c")}, l.Pipe, l.Stop, func(i int, n pathExpr.Node) bool {
+		got = append(got, fmt.Sprintf("%d:%s", i, n.Value))
+		return true
+	}, tracer)
+	if expect := []string{"0:1", "0:1", "0:2", "0:1", "0:3", "1:3"}; !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected the nodes to be passed on as they're read, %q, got %q\n", expect, got)
+	}
+	var notFound *pathExpr.NotFoundError
+	if len(results[0].Nodes) != 5 || results[1].Value != "3" || errs[0] != nil || !errors.As(errs[2], &notFound) {
+		t.Errorf("expected 5 ks, a 3 and nothing, got %q, %q, %v\n", nodeValues(results[0]), results[1].Value, errs)
+	}
+
+	// a first field out of a big document, from its root, whose end is
+	// never read, nor more than a little of the rest
+	var bigJSON, bigXML bytes.Buffer
+	bigJSON.WriteString(`{"universe": {"galaxy": [`)
+	bigXML.WriteString(`<universe>`)
+	for i := 0; i < 100000; i++ {
+		if i > 0 {
+			bigJSON.WriteString(", ")
+		}
+		fmt.Fprintf(&bigJSON, `{"id": %d, "world": "w%d"}`, i, i)
+		fmt.Fprintf(&bigXML, `<galaxy><id>%d</id><world>w%d</world></galaxy>`, i, i)
+	}
+	bigJSON.WriteString("]}}")
+	bigXML.WriteString(`</universe>`)
+	var bigTests = []struct {
+		name   string
+		big    *bytes.Buffer
+		start  func(context.Context, io.Reader, trace.Trace) *lexer.Lexer
+		expr   string
+		expect string
+	}{
+		{ name: "json", big: &bigJSON, start: json_lexer.Start, expr: `/universe/galaxy[id="2"]/world`, expect: "w2"},
+		{ name: "json", big: &bigJSON, start: json_lexer.Start, expr: `/universe/galaxy[world="w2"]`, expect: "2 w2"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[id="2"]/world`, expect: "w2"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[world="w5"]/world`, expect: "w5"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy/world`, expect: "w0"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[2]`, expect: "1 w1"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[3]/id`, expect: "2"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[id>6]/world`, expect: "w7"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `/universe/galaxy[world!="w0"]`, expect: "1 w1"},
+		{ name: "xml", big: &bigXML, start: xml_lexer.Start, expr: `//world`, expect: "w0"},
+		{ name: "json", big: &bigJSON, start: json_lexer.Start, expr: `/universe/galaxy[2]`, expect: "1 w1"},
+		{ name: "json", big: &bigJSON, start: json_lexer.Start, expr: `/universe/galaxy[id>6]/world`, expect: "w7"},
+	}
+	for i, test := range bigTests {
+		c := &counter{r: bytes.NewReader(test.big.Bytes())}
+		l := test.start(context.Background(), c, tracer)
+		if r, err := pathExpr.Stream(l.Pipe, test.expr, l.Stop, first, tracer); r.Value != test.expect || err != nil {
+			t.Errorf("%s %d: %s expected %q, got %q, %v\n", test.name, i, test.expr, test.expect, r.Value, err)
+		}
+		if c.n > test.big.Len() / 100 {
+			t.Errorf("%s %d: %s expected to stop early, but read %d of %d bytes\n",
+				test.name, i, test.expr, c.n, test.big.Len())
+		}
+	}
+
+	// all of what's selected, but only as far as more can be, as the
+	// first galaxy is the only one /galaxy[1] looks in
+	var worldless bytes.Buffer
+	worldless.WriteString(`<universe><galaxy><id>0</id></galaxy>`)
+	end := worldless.Len()
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&worldless, `<galaxy><world>w%d</world></galaxy>`, i)
+	}
+	worldless.WriteString(`</universe>`)
+	for i, expr := range []string{ `/universe/galaxy[1]/world`, `/universe/galaxy[id="0"][1]/world`, `/nebula//world` } {
+		c := &counter{r: bytes.NewReader(worldless.Bytes())}
+		l := xml_lexer.Start(context.Background(), c, tracer)
+		if r, err := pathExpr.Stream(l.Pipe, expr, l.Stop, nil, tracer); !errors.As(err, &notFound) || len(r.Nodes) != 0 {
+			t.Errorf("worldless %d: %s expected nothing, got %q, %v\n", i, expr, r.Value, err)
+		}
+		if c.n > end + 8192 {
+			t.Errorf("worldless %d: %s expected to stop at %d, but read %d of %d bytes\n", i, expr, end, c.n, worldless.Len())
+		}
+	}
+
+	// and one that's long, in which the steps are tried again and again,
+	// read no further than its end
+	var long bytes.Buffer
+	long.WriteString(`<universe><galaxy><id>0</id>`)
+	long.WriteString(strings.Repeat(`<galaxy/>`, 20000))
+	long.WriteString(`</galaxy>`)
+	end = long.Len()
+	long.WriteString(strings.Repeat(`<galaxy><id>1</id></galaxy>`, 40000))
+	long.WriteString(`</universe>`)
+	for i, expr := range []string{ `/universe/galaxy[1]`, `/universe/galaxy[id="0"]`, `/universe/galaxy[id<1]` } {
+		c := &counter{r: bytes.NewReader(long.Bytes())}
+		l := xml_lexer.Start(context.Background(), c, tracer)
+		if r, err := pathExpr.Stream(l.Pipe, expr, l.Stop, first, tracer); r.Value != "0" || err != nil {
+			t.Errorf("long %d: %s expected %q, got %q, %v\n", i, expr, "0", r.Value, err)
+		}
+		if c.n > end + end / 10 {
+			t.Errorf("long %d: %s expected to stop at %d, but read %d of %d bytes\n", i, expr, end, c.n, long.Len())
+		}
+	}
+}
+
+// endless is a json array that never ends
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = "1,"[i % 2]
+	}
+	return len(p) - len(p) % 2, nil
+}
+
+// Cancelling or timing out stops a lexer, and no lexer goroutine outlives
+// its Lex, even when the lexer has more to say after an EOF
+func TestCancel(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		json_lexer.Lex(`{"a": 1, abc`, tracer)
+		xml_lexer.Lex(`<a>b</a`, tracer)
+		msgpack.Lex("\x92\x01", tracer)
+		cbor.Lex("\x82\x01", tracer)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tokens := json_lexer.LexContext(ctx, jsonInput, tracer)
+	if last := tokens[len(tokens)-1]; last.Typ != token.ERROR || last.Val != context.Canceled.Error() {
+		t.Errorf("expected a cancelled lex to end in an ERROR, got %v\n", last)
+	}
+	tokens = cbor.LexContext(ctx, cborInput, tracer)
+	if last := tokens[len(tokens)-1]; last.Typ != token.ERROR || last.Val != context.Canceled.Error() {
+		t.Errorf("expected a cancelled decode to end in an ERROR, got %v\n", last)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	tokens = json_lexer.Start(ctx, io.MultiReader(strings.NewReader(`{"a": [`), endless{}), tracer).Tokens()
+	if last := tokens[len(tokens)-1]; last.Typ != token.ERROR || last.Val != context.DeadlineExceeded.Error() {
+		t.Errorf("expected an endless lex to time out, got %v\n", last)
+	}
+
+	// give the goroutines a moment to finish
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected %d goroutines, leaked %d\n", before, after - before)
+	}
+}
+
+// lexKey and lexValue are the states of a toy in-house format, lines
+// of key=value, to show one can be registered without changing main
+func lexKey(l *lexer.Lexer) lexer.StateFn {
+	for {
+		switch c := l.Next(); {
+		case c == '=':
+			l.Backup()
+			l.Push(l.Current())
+			l.Emit(token.BEGIN, l.Current())
+			l.Next()
+			l.Ignore()
+			return lexValue
+		case c < 0:
+			l.Emit(token.EOF, "")
+			return nil
+		}
+	}
+}
+
+func lexValue(l *lexer.Lexer) lexer.StateFn {
+	for c := l.Next(); c != '\n' && c >= 0; c = l.Next() {
+	}
+	l.Backup()
+	l.Emit(token.VALUE, l.Current())
+	l.Emit(token.END, l.Pop())
+	l.Next()
+	l.Ignore()
+	return lexKey
+}
+
+func TestRegistry(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	err := format.Register(format.Format{Name: "kv", Usage: "parse key=value lines", Priority: 10,
+		Detect: func(s string) bool { return strings.HasPrefix(s, "#kv\n") },
+		Lex: format.FromStates(lexKey)})
+	if err != nil {
+		t.Fatalf("expected kv to be registered, got %v\n", err)
+	}
+	defer format.Unregister("kv")
+
+	var last = -1
+	for _, f := range format.Formats() {
+		if f.Priority < last {
+			t.Errorf("expected formats in detection order, %s is out of place\n", f.Name)
+		}
+		last = f.Priority
+	}
+	if guessType("#kv\ntimelord=who\ncompanion=rose\n", tracer) != "kv" {
+		t.Errorf("expected the kv format to be detected\n")
+	}
+	docs, err := documents("", "", "#kv\ntimelord=who\ncompanion=rose\n", nil, tracer)
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("expected one document, got %d, %v\n", len(docs), err)
+	}
+	if value := evaluate(docs[0].tokens, "/companion", false, tracer); value != "rose" {
+		t.Errorf("expected %q, got %q\n", "rose", value)
+	}
+	for name, input := range map[string]string{"json": jsonInput, "xml": xmlInput, "cbor": cborInput} {
+		if guessed := guessType(input, tracer); guessed != name {
+			t.Errorf("expected %s to be detected, got %s\n", name, guessed)
+		}
+	}
+
+	// archives are formats too, whose members are read by their own
+	for _, name := range []string{"zip", "tar"} {
+		if f, ok := format.Lookup(name); !ok || f.Unpack == nil || f.Lex != nil {
+			t.Errorf("expected %s to be registered as a container\n", name)
+		}
+	}
+
+	// names can't be taken twice, nor clash with the flags
+	var refused = []struct {
+		name string
+		f    format.Format
+	}{
+		{ name: "lexed and unpacked", f: format.Format{Name: "both", Lex: format.FromStates(lexKey),
+			Unpack: func(string, format.Options, trace.Trace) ([]unpack.Member, error) { return nil, nil }}},
+		{ name: "neither", f: format.Format{Name: "neither"}},
+		{ name: "a second kv", f: format.Format{Name: "kv", Lex: format.FromStates(lexKey)}},
+		{ name: "a flag", f: format.Format{Name: "first", Lex: format.FromStates(lexKey)}},
+		{ name: "an option", f: format.Format{Name: "members", Lex: format.FromStates(lexKey)}},
+		{ name: "an option called for a flag", f: format.Format{Name: "kv2", Lex: format.FromStates(lexKey),
+			Options: []format.Option{{Name: "trace", Bool: true}}}},
+		{ name: "an option called for a format", f: format.Format{Name: "kv2", Lex: format.FromStates(lexKey),
+			Options: []format.Option{{Name: "json", Bool: true}}}},
+		{ name: "an option of another kind", f: format.Format{Name: "kv2", Lex: format.FromStates(lexKey),
+			Options: []format.Option{{Name: "logxml"}}}},
+	}
+	for i, test := range refused {
+		if err := format.Register(test.f); err == nil {
+			format.Unregister(test.f.Name)
+			t.Errorf("%d: expected %s to be refused\n", i, test.name)
+		}
+	}
+	if f, _ := format.Lookup("kv"); f.Priority != 10 {
+		t.Errorf("expected the first kv to be kept, got priority %d\n", f.Priority)
+	}
+
+	// a format that can stream needs no Lex func of its own
+	err = format.Register(format.Format{Name: "kvstream", Usage: "stream key=value lines",
+		Start: func(ctx context.Context, r io.Reader, tp trace.Trace) *lexer.Lexer {
+			return lexer.Start(ctx, r, lexKey, tp)
+		}})
+	if err != nil {
+		t.Fatalf("expected kvstream to be registered, got %v\n", err)
+	}
+	defer format.Unregister("kvstream")
+	docs, err = documents("", "kvstream", "timelord=who\ncompanion=rose\n", nil, tracer)
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("expected one streamed document, got %d, %v\n", len(docs), err)
+	}
+	if value := evaluate(docs[0].tokens, "/timelord", false, tracer); value != "who" {
+		t.Errorf("expected %q, got %q\n", "who", value)
+	}
+
+	// text with commas isn't taken for csv, which is only read by name
+	if guessed := guessType("one, two, three", tracer); guessed != "unguessed" {
+		t.Errorf("expected commas not to be guessed, got %s\n", guessed)
+	}
+}
+
+// Test the parser on its own, and on quotes the string walk used to break on
+func TestParser(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var good = []struct {
+		expr  string
+		parse string
+	}{
+		{expr: "/universe/world", parse: "/universe/world"},
+		{expr: "universe/galaxy[ world = earth ]/", parse: `universe/galaxy[world="earth"]`},
+		{expr: "//world", parse: "//world"},
+		{expr: "/a//b[2]", parse: "/a//b[2]"},
+		{expr: `/a['k'="x/y]"]`, parse: `/a[k="x/y]"]`},
+		{expr: `/"first name"`, parse: `/"first name"`},
+		{expr: "/event/payload/parse(json)/id", parse: "/event/payload/parse(json)/id"},
+		{expr: "/", parse: "/"},
+		{expr: "/universe/*/timelord", parse: "/universe/*/timelord"},
+		{expr: `/user/~'user_?[iI][dD]'`, parse: `/user/~"user_?[iI][dD]"`},
+		{expr: `/"*"[2]`, parse: `/"*"[2]`},
+		{expr: "/a/b/../c/.", parse: "/a/b/../c/."},
+		{expr: "/a/following-sibling::b[2]", parse: "/a/following-sibling::b[2]"},
+		{expr: "/a/descendant::b/child::c", parse: "/a//b/c"},
+		{expr: `ancestor::*/preceding-sibling::~"x"`, parse: `ancestor::*/preceding-sibling::~"x"`},
+		{expr: `/"a::b"/".."`, parse: `/"a::b"/".."`},
+		{expr: "/a[ b >= 1 ]", parse: `/a[b>="1"]`},
+		{expr: "/a[b!=x]/c[d<'2']", parse: `/a[b!="x"]/c[d<"2"]`},
+		{expr: "/a[b<=-1.5][c>z]", parse: `/a[b<="-1.5"][c>"z"]`},
+	}
+	for i, test := range good {
+		lp, err := pathExpr.ParseExpr(test.expr)
+		if err != nil {
+			t.Errorf("%d: %q failed to parse, %v\n", i, test.expr, err)
+		} else if lp.String() != test.parse {
+			t.Errorf("%d: %q parsed as %q, expected %q\n", i, test.expr, lp, test.parse)
+		}
+	}
+
+	var bad = []struct {
+		expr   string
+		column int
+	}{
+		{expr: "", column: 1},
+		{expr: "/galaxy[", column: 9},
+		{expr: "/galaxy[world=]", column: 15},
+		{expr: `/galaxy[world="earth]`, column: 15},
+		{expr: "/galaxy[0]", column: 9},
+		{expr: "/a///b", column: 5},
+		{expr: "/a]", column: 3},
+		{expr: "/parse(yaml)", column: 8},
+		{expr: "/a//", column: 5},
+		{expr: `/~"a("`, column: 3},
+		{expr: "/~a", column: 3},
+		{expr: "/a/sideways::b", column: 4},
+		{expr: "/a//parent::b", column: 5},
+		{expr: "/a//..", column: 5},
+		{expr: "/a/..[1]", column: 6},
+		{expr: "/a/parent::", column: 12},
+		{expr: "/a[b=>1]", column: 6},
+		{expr: "/a[b!1]", column: 5},
+		{expr: "/a[b]", column: 5},
+	}
+	for i, test := range bad {
+		_, err := pathExpr.ParseExpr(test.expr)
+		se, ok := err.(*pathExpr.SyntaxError)
+		if !ok {
+			t.Errorf("%d: %q expected a syntax error, got %v\n", i, test.expr, err)
+			continue
+		}
+		if se.Pos+1 != test.column {
+			t.Errorf("%d: %q expected an error at column %d, got %v\n", i, test.expr, test.column, err)
+		}
+		if !strings.HasSuffix(err.Error(), "\n\t"+strings.Repeat(" ", test.column-1)+"^") {
+			t.Errorf("%d: %q expected a caret at column %d, got %v\n", i, test.expr, test.column, err)
+		}
+	}
+
+	// the caret counts characters, not bytes
+	_, err := pathExpr.ParseExpr("/café/[")
+	if err == nil || !strings.HasPrefix(err.Error(), "syntax error at column 7 ") ||
+		!strings.HasSuffix(err.Error(), "\n\t      ^") {
+		t.Errorf("expected a caret under the [ after café, got %v\n", err)
+	}
+
+	// and what's printed parses back to the same thing
+	for i, expr := range []string{
+		"/\"tab\there\"[v=\"new\nline\"]",
+		`/a[b="back\\slash"]/"say \"hi\""`,
+		"/café[prix<\"\x7f\x01\"]",
+		`/~"\\d+\"?"`,
+		`//'it\'s'[x='\'']`,
+	} {
+		lp, err := pathExpr.ParseExpr(expr)
+		if err != nil {
+			t.Errorf("%d: %q failed to parse, %v\n", i, expr, err)
+			continue
+		}
+		again, err := pathExpr.ParseExpr(lp.String())
+		if err != nil || again.String() != lp.String() || len(again.Steps) != len(lp.Steps) {
+			t.Errorf("%d: %q printed as %q, which parsed as %v, %v\n", i, expr, lp, again, err)
+			continue
+		}
+		for j, st := range lp.Steps {
+			var before, after pathExpr.Comparison
+			if len(st.Predicates) > 0 {
+				before, after = *st.Predicates[0].(*pathExpr.Comparison), *again.Steps[j].Predicates[0].(*pathExpr.Comparison)
+				before.Pos, after.Pos = 0, 0
+			}
+			if again.Steps[j].Name != st.Name || after != before {
+				t.Errorf("%d: %q printed as %q, whose step %d parsed as %q\n", i, expr, lp, j, again.Steps[j])
+			}
+		}
+	}
+
+	tokens := json_lexer.Lex(`{"a": [{"k": "x/y]", "v": "hit"}, {"k": "z", "v": "miss"}]}`, tracer)
+	if value := evaluate(tokens, `/a[k="x/y]"]/v`, false, tracer); value != "hit" {
+		t.Errorf("expected %q, got %q\n", "hit", value)
+	}
+}
+
+// A compiled expression is evaluated many times, from many goroutines
+func TestCompile(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	if _, err := pathExpr.Compile("/galaxy[1][2]"); err != nil {
+		t.Errorf("expected two predicates on a step to compile, got %v\n", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected MustCompile to panic on a bad expression\n")
+			}
+		}()
+		pathExpr.MustCompile("/galaxy[")
+	}()
+
+	e := pathExpr.MustCompile(`/universe/galaxy[world="earth"]/timelord`)
+	if e.String() != `/universe/galaxy[world="earth"]/timelord` {
+		t.Errorf("expected the expression back, got %q\n", e)
+	}
+	if expect := `.FindChildSuchThat("galaxy", "world", "earth").FindChild("timelord")`; !strings.Contains(e.Explain(), expect) {
+		t.Errorf("expected an explanation containing %s, got %s\n", expect, e.Explain())
+	}
+
+	paths := []pathExpr.Path{
+		pathExpr.NewPath(xml_lexer.Lex(xmlInput, tracer), tracer),
+		pathExpr.NewPath(json_lexer.Lex(jsonInput, tracer), tracer),
+	}
+	var wg sync.WaitGroup
+	values := make([]string, 20)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, _ := e.Eval(paths[i%len(paths)])
+			values[i] = r.Value
+		}(i)
+	}
+	wg.Wait()
+	for i, value := range values {
+		if value != "who" {
+			t.Errorf("%d: expected %q, got %q\n", i, "who", value)
+		}
+	}
+}
+
+// Errors and warnings are returned, so not found can be told from empty
+func TestErrors(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	path := pathExpr.NewPath(json_lexer.Lex(`{"a": {"b": "", "c": "x"}, `+
+		`"d": [{"k": "1", "v": "y"}, {"k": "1", "v": "z"}]}`, tracer), tracer)
+	var notFound *pathExpr.NotFoundError
+	var ambiguous *pathExpr.AmbiguousError
+	var syntax *pathExpr.SyntaxError
+
+	r, err := path.Interpreter("/a/b", tracer)
+	if err != nil || r.Value != "" || len(r.Warnings) != 1 {
+		t.Errorf("expected an empty value with a warning, got %q, %v, %v\n", r.Value, r.Warnings, err)
+	}
+	r, err = path.Interpreter("/a/e", tracer)
+	if !errors.As(err, &notFound) || notFound.Pos != 3 || r.Value != "" {
+		t.Errorf("expected e not to be found at column 4, got %q, %v\n", r.Value, err)
+	}
+	r, err = path.Interpreter(`/d[k="2"]/v`, tracer)
+	if !errors.As(err, &notFound) || notFound.Step != `d[k="2"]` {
+		t.Errorf("expected d[k=2] not to be found, got %q, %v\n", r.Value, err)
+	}
+	r, err = path.Interpreter(`/d[k="1"]/v`, tracer)
+	if !errors.As(err, &ambiguous) || r.Value != "y" {
+		t.Errorf("expected an ambiguous y, got %q, %v\n", r.Value, err)
+	}
+	r, err = path.Interpreter("/a", tracer)
+	if err != nil || r.Value != "x" || len(r.Warnings) != 0 {
+		t.Errorf("expected x alone, got %q, %v, %v\n", r.Value, r.Warnings, err)
+	}
+	r, err = path.Interpreter("/d", tracer)
+	if err != nil || r.Value != "1 y" || len(r.Warnings) != 1 {
+		t.Errorf("expected two values with a warning, got %q, %v, %v\n", r.Value, r.Warnings, err)
+	}
+	if _, err = path.Interpreter("/a[", tracer); !errors.As(err, &syntax) {
+		t.Errorf("expected a syntax error, got %v\n", err)
+	}
+
+	// each has an exit status of its own, and the most serious one wins
+	var statuses = []struct {
+		expression string
+		status     int
+	}{
+		{ expression: "/a", status: 0 },
+		{ expression: "/a/e", status: 4 },
+		{ expression: `/d[k="1"]/v`, status: 5 },
+	}
+	for i, test := range statuses {
+		_, err = path.Interpreter(test.expression, tracer)
+		if status := statusOf(err); status != test.status {
+			t.Errorf("%d: %s exits %d, expected %d\n", i, test.expression, status, test.status)
+		}
+	}
+	if status := worse(worse(worse(5, 3), 4), 2); status != 3 {
+		t.Errorf("expected unreadable input to be the most serious, got %d\n", status)
+	}
+	if status := worse(worse(0, 5), 4); status != 4 {
+		t.Errorf("expected not found to be worse than ambiguous, got %d\n", status)
+	}
+}
+
+// nodeValues returns the values of the nodes a result has, or nil if it
+// has none
+func nodeValues(r *pathExpr.Result) []string {
+	var values []string
+
+	for _, n := range r.Nodes {
+		values = append(values, n.Value)
+	}
+	return values
+}
+
+// recorder is a trace that keeps what it's given, to see whose it is
+type recorder struct {
+	lines []string
+}
+
+func (r *recorder) Begin(args ...interface{}) func() {
+	r.lines = append(r.lines, fmt.Sprint(args...))
+	return func() {}
+}
+
+func (r *recorder) Printf(format string, v ...interface{}) {
+	r.lines = append(r.lines, fmt.Sprintf(format, v...))
+}
+
+func (r *recorder) Print(s string) {
+	r.lines = append(r.lines, s)
+}
+
+// Evaluations on different goroutines share nothing, not even a trace.
+// Run with -race to see there's nothing for them to race on.
+func TestConcurrentEvaluation(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var tests = []struct {
+		input  string
+		expr   string
+		expect string
+	}{
+		{input: xmlInput, expr: `/universe/galaxy[world="earth"]/timelord`, expect: "who"},
+		{input: jsonInput, expr: `//galaxy[2]/timelord`, expect: "who"},
+		{input: `{"a": {"b": "c"}}`, expr: "/a/nothing", expect: ""},
+	}
+	var wg sync.WaitGroup
+	traces := make([]*recorder, 30)
+	values := make([]string, len(traces))
+	warned := make([]int, len(traces))
+	for i := range traces {
+		traces[i] = &recorder{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			test := tests[i%len(tests)]
+			path := pathExpr.NewPath(json_lexer.Lex(test.input, tracer), traces[i])
+			if test.input == xmlInput {
+				path = pathExpr.NewPath(xml_lexer.Lex(test.input, tracer), traces[i])
+			}
+			r, _ := path.Interpreter(test.expr, traces[i])
+			values[i], warned[i] = r.Value, len(r.Warnings)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, r := range traces {
+		test := tests[i%len(tests)]
+		if values[i] != test.expect || warned[i] != 0 {
+			t.Errorf("%d: expected %q without warnings, got %q and %d\n", i, test.expect, values[i], warned[i])
+		}
+		for _, other := range tests {
+			if other.expr == test.expr {
+				continue
+			}
+			for _, line := range r.lines {
+				if strings.Contains(line, other.expr) {
+					t.Errorf("%d: the trace of %q has %q in it\n", i, test.expr, line)
+				}
+			}
+		}
+	}
+}
+
+// Positions count among the children of each parent, and results never
+// come from the wrong parent
+func TestChildAxis(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var shop = `<shop><order><id>1</id><item>pen</item></order>` +
+		`<order><id>2</id><item>ink</item><item>nib</item></order></shop>`
+	var tokens = xml_lexer.Lex(shop, tracer)
+	var tests = []struct {
+		expr   string
+		expect string
+	}{
+		{ expr: "/shop/order/id", expect: "1"},
+		{ expr: "/shop/order/item[2]", expect: "nib"},
+		{ expr: "/shop/order[2]/item", expect: "ink"},
+		{ expr: `/shop/order[id="2"]/item[2]`, expect: "nib"},
+		{ expr: "//item[2]", expect: "nib"},
+		{ expr: "/shop//item[3]", expect: ""},
+		{ expr: "/shop/order/item[3]", expect: ""},
+		{ expr: "/shop/item", expect: ""},
+	}
+	var x *os.File
+	x, os.Stderr = os.Stderr, devNull()
+	for i, test := range tests {
+		if value := evaluate(tokens, test.expr, false, tracer); value != test.expect {
+			t.Errorf("%d: { expr:%q, expect:%q }, get %q\n", i, test.expr, test.expect, value)
+		}
+		l := xml_lexer.Start(context.Background(), strings.NewReader(shop), tracer)
+		if r, _ := pathExpr.Stream(l.Pipe, test.expr, l.Stop, nil, tracer); r.Value != test.expect {
+			t.Errorf("%d: streaming { expr:%q, expect:%q }, get %q\n", i, test.expr, test.expect, r.Value)
+		}
+	}
+	os.Stderr = x
+
+	// the primitives stay within their parent too
+	path := pathExpr.NewPath(tokens, tracer)
+	first := path.FindChild("shop").FindNth("order", 1)
+	if item := first.FindFirst("item"); item.TextValue() != "pen" || item.FindNext("item") != nil {
+		t.Errorf("expected pen alone in the first order, got %q then %v\n",
+			item.TextValue(), item.FindNext("item"))
+	}
+	if value := path.FindChild("shop").FindNth("order", 2).FindNth("item", 2).TextValue(); value != "nib" {
+		t.Errorf("expected nib, got %q\n", value)
+	}
+	if value := path.FindNthDescendant("item", 2).TextValue(); value != "nib" {
+		t.Errorf("expected the second item of an order, nib, got %q\n", value)
+	}
+	if second := path.FindChild("shop").FindNth("order", 3); second != nil {
+		t.Errorf("expected no third order, got %v\n", second)
+	}
+}
+
+// Predicates on a step are taken in turn, each on what the one before it
+// left, so positions count only what's left
+func TestStackedPredicates(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var shop = `<shop><order><id>1</id><item>pen</item></order>` +
+		`<order><id>2</id><item>ink</item><item>nib</item></order>` +
+		`<order><id>2</id><item>cap</item></order></shop>`
+	var tokens = xml_lexer.Lex(shop, tracer)
+	var tests = []struct {
+		expr   string
+		expect string
+	}{
+		{ expr: `/shop/order[id="2"][2]/item`, expect: "cap"},
+		{ expr: `/shop/order[2][id="2"]/item[1]`, expect: "ink"},
+		{ expr: `/shop/order[id>0][id<2]/item`, expect: "pen"},
+		{ expr: `/shop/order[id="1"][2]`, expect: ""},
+		{ expr: `/shop/order[3][id="1"]`, expect: ""},
+		{ expr: `/shop/order/item[1][2]`, expect: ""},
+		{ expr: `//order[item="nib"][1]/id`, expect: "2"},
+		{ expr: `/shop/order[3]/preceding-sibling::order[id="2"][1]/item[2]`, expect: "nib"},
+		{ expr: `/shop/order[1]/following-sibling::order[id="2"][2]/item`, expect: "cap"},
+	}
+	var x *os.File
+	x, os.Stderr = os.Stderr, devNull()
+	for i, test := range tests {
+		if value := evaluate(tokens, test.expr, false, tracer); value != test.expect {
+			t.Errorf("%d: { expr:%q, expect:%q }, get %q\n", i, test.expr, test.expect, value)
+		}
+		l := xml_lexer.Start(context.Background(), strings.NewReader(shop), tracer)
+		if r, _ := pathExpr.Stream(l.Pipe, test.expr, l.Stop, nil, tracer); r.Value != test.expect {
+			t.Errorf("%d: streaming { expr:%q, expect:%q }, get %q\n", i, test.expr, test.expect, r.Value)
+		}
+	}
+	os.Stderr = x
+
+	// which the explanation does with an Element, as can be done by hand
+	explanation := pathExpr.MustCompile(`/shop/order[id="2"][2]/item`).Explain()
+	if expect := `.Step(pathExpr.Child, "order", &pathExpr.Comparison{Name: "id", Op: "=", Value: "2"}, ` +
+		`&pathExpr.Position{N: 2})`; !strings.Contains(explanation, expect) {
+		t.Errorf("expected the explanation to have %q in it, got %q\n", expect, explanation)
+	}
+	path := pathExpr.NewPath(tokens, tracer)
+	shopPath := path.FindChild("shop")
+	if value := pathExpr.ElementOf(path, shopPath).Step(pathExpr.Child, "order",
+		&pathExpr.Comparison{Name: "id", Op: "=", Value: "2"}, &pathExpr.Position{N: 2}).Contents().FindChild("item").TextValue(); value != "cap" {
+		t.Errorf("expected the second order with id 2 to have cap, got %q\n", value)
+	}
+}
+
+// An evaluation selects every element that satisfies it, in document
+// order, each with its own text value, and jxpath prints them all
+func TestNodeSets(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var tests = []struct {
+		expr   string
+		expect []string
+	}{
+		{ expr: "//world", expect: []string{"nada", "earth", ""}},
+		{ expr: "/universe/galaxy", expect: []string{"nada", "earth  who"}},
+		{ expr: `/universe/galaxy[world="earth"]/world`, expect: []string{"earth", ""}},
+		{ expr: "//timelord", expect: []string{"who", "master"}},
+		{ expr: "//galaxy[2]/timelord", expect: []string{"who"}},
+		{ expr: "/universe/nothing", expect: nil},
+	}
+	path := pathExpr.NewPath(xml_lexer.Lex(xmlInput, tracer), tracer)
+	for i, test := range tests {
+		r, _ := pathExpr.MustCompile(test.expr).EvalTrace(path, tracer)
+		var values []string
+		for _, n := range r.Nodes {
+			values = append(values, n.Value)
+		}
+		if !reflect.DeepEqual(values, test.expect) {
+			t.Errorf("%d: { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, values)
+		}
+		if len(r.Nodes) > 0 && (r.Value != r.Nodes[0].Value || r.Nodes[0].Name == "") {
+			t.Errorf("%d: expected the value and name of the first node, got %q and %+v\n",
+				i, r.Value, r.Nodes[0])
+		}
+	}
+
+	// the nodes are elements in their own right
+	r, _ := pathExpr.MustCompile("/universe/galaxy").Eval(path)
+	if who := r.Nodes[1].Path.FindChild("timelord").TextValue(); who != "who" {
+		t.Errorf("expected the second galaxy to have who, got %q\n", who)
+	}
+
+	// one line each, or a json array of them all
+	var x *os.File
+	x, os.Stderr = os.Stderr, devNull()
+	var b bytes.Buffer
+	out := output{w: &b, format: "lines"}
+	e := pathExpr.MustCompile("//timelord")
+	r, err := e.Eval(path)
+	out.report("", 0, e, r, err)
+	out.flush()
+	if expect := "0: path expression \"//timelord\" selected \"who\"\n" +
+		"0: path expression \"//timelord\" selected \"master\"\n"; b.String() != expect {
+		t.Errorf("expected %q, got %q\n", expect, b.String())
+	}
+	b.Reset()
+	out = output{w: &b, format: "json", first: true}
+	out.report("a.xml", 0, e, r, err)
+	nothing := pathExpr.MustCompile("/nothing")
+	r, err = nothing.Eval(path)
+	out.report("a.xml", 1, nothing, r, err)
+	out.flush()
+	os.Stderr = x
+	var results []jsonResult
+	if err := json.Unmarshal(b.Bytes(), &results); err != nil {
+		t.Fatalf("expected a json array, got %q, %v\n", b.String(), err)
+	}
+	expect := []jsonResult{{Document: "a.xml", Expression: "//timelord", Name: "timelord", Value: "who"}}
+	if !reflect.DeepEqual(results, expect) {
+		t.Errorf("expected %+v, got %+v\n", expect, results)
+	}
+}
+
+// A * matches elements of any name, and a ~"regex" those whose whole name
+// it matches, but neither matches the unnamed elements around documents
+func TestNameTests(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var users = `{"v1": {"user": {"userId": "1"}}, "v2": {"user": {"user_id": "2"}}, ` +
+		`"v3": {"user": {"userID": "3", "userIdentity": "x"}}}`
+	var tests = []struct {
+		input  string
+		expr   string
+		expect []string
+	}{
+		{ input: xmlInput, expr: "/universe/*/timelord", expect: []string{"who"}},
+		// attributes are elements too
+		{ input: xmlInput, expr: "/universe/*", expect: []string{"false", "true", "nada", "earth  who", "master"}},
+		{ input: xmlInput, expr: "/universe/*[5]", expect: []string{"master"}},
+		{ input: xmlInput, expr: `//*[world="earth"]/timelord`, expect: []string{"who"}},
+		{ input: xmlInput, expr: "/*/galaxy[2]/world", expect: []string{"earth", ""}},
+		{ input: xmlInput, expr: `/universe/~"time.*"`, expect: []string{"master"}},
+		{ input: xmlInput, expr: `//~"w.r.d"`, expect: []string{"nada", "earth", ""}},
+		{ input: xmlInput, expr: `/universe/~"time"`, expect: nil},
+		{ input: users, expr: `//user/~"user_?[iI][dD]"`, expect: []string{"1", "2", "3"}},
+		{ input: users, expr: `/*/user/~"user_?[iI][dD]"`, expect: []string{"1", "2", "3"}},
+		{ input: users, expr: "/*[2]/user", expect: []string{"2"}},
+		{ input: `{"*": "star", "a": "b"}`, expr: `/"*"`, expect: []string{"star"}},
+	}
+	for i, test := range tests {
+		var tokens []token.Token
+		if test.input == xmlInput {
+			tokens = xml_lexer.Lex(test.input, tracer)
+		} else {
+			tokens = json_lexer.Lex(test.input, tracer)
+		}
+		r, _ := pathExpr.MustCompile(test.expr).EvalTrace(pathExpr.NewPath(tokens, tracer), tracer)
+		var values []string
+		for _, n := range r.Nodes {
+			values = append(values, n.Value)
+		}
+		if !reflect.DeepEqual(values, test.expect) {
+			t.Errorf("%d: { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, values)
+		}
+		if test.input != xmlInput {
+			continue
+		}
+		// streaming selects them all as well, as they're read
+		l := xml_lexer.Start(context.Background(), strings.NewReader(test.input), tracer)
+		r, _ = pathExpr.Stream(l.Pipe, test.expr, l.Stop, nil, tracer)
+		if streamed := nodeValues(r); !reflect.DeepEqual(streamed, test.expect) {
+			t.Errorf("%d: streaming { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, streamed)
+		}
+	}
+
+	// and the primitives the explanation gives
+	path := pathExpr.NewPath(json_lexer.Lex(users, tracer), tracer)
+	id := regexp.MustCompile("^(?:user_?[iI][dD])$")
+	if value := path.FindNthMatching(pathExpr.AnyName, 3).FindChild("user").FindChildMatching(id).TextValue(); value != "3" {
+		t.Errorf("expected 3, got %q\n", value)
+	}
+	if value := path.FindDescendantMatching(regexp.MustCompile("^user_id$")).TextValue(); value != "2" {
+		t.Errorf("expected 2, got %q\n", value)
+	}
+	if value := path.FindChildMatchingSuchThat(regexp.MustCompile("^v"), "user", "3 x").FindChild("user").FindChild("userID").TextValue(); value != "3" {
+		t.Errorf("expected v3's user, got %q\n", value)
+	}
+}
+
+// The axes that go up and sideways, so what's beside an element can be
+// found from it
+func TestAxes(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var shop = `<shop><order><item>pen</item><price>2</price><item>ink</item><price>5</price></order>` +
+		`<order><id>7</id><item>nib</item><price>1</price></order></shop>`
+	var tests = []struct {
+		expr   string
+		expect []string
+	}{
+		{ expr: "//item/..", expect: []string{"pen 2 ink 5", "7 nib 1"}},
+		{ expr: "/shop/order[id=\"7\"]/item/../price", expect: []string{"1"}},
+		{ expr: "/shop/order/./item/.", expect: []string{"pen", "ink", "nib"}},
+		{ expr: "/shop/..", expect: []string{"pen 2 ink 5 7 nib 1"}},
+		{ expr: "/..", expect: nil},
+		{ expr: "//item[2]/following-sibling::price", expect: []string{"5"}},
+		{ expr: "//item/following-sibling::price[1]", expect: []string{"2", "5", "1"}},
+		{ expr: "/shop/order/id/following-sibling::*", expect: []string{"nib", "1"}},
+		{ expr: "//price/preceding-sibling::item[1]", expect: []string{"pen", "ink", "nib"}},
+		{ expr: "//price[2]/preceding-sibling::*", expect: []string{"pen", "2", "ink"}},
+		{ expr: "//price[2]/preceding-sibling::*[2]", expect: []string{"2"}},
+		{ expr: "//item/ancestor::shop", expect: []string{"pen 2 ink 5 7 nib 1"}},
+		{ expr: "//id/ancestor::*", expect: []string{"pen 2 ink 5 7 nib 1", "7 nib 1"}},
+		{ expr: "//id/ancestor::*[1]/item", expect: []string{"nib"}},
+		{ expr: `//item/parent::order[id="7"]/price`, expect: []string{"1"}},
+		{ expr: "//item/self::item[2]", expect: nil},
+		{ expr: "//*/self::price", expect: []string{"2", "5", "1"}},
+		{ expr: "/shop/following-sibling::shop", expect: nil},
+	}
+	path := pathExpr.NewPath(xml_lexer.Lex(shop, tracer), tracer)
+	for i, test := range tests {
+		r, _ := pathExpr.MustCompile(test.expr).EvalTrace(path, tracer)
+		var values []string
+		for _, n := range r.Nodes {
+			values = append(values, n.Value)
+		}
+		if !reflect.DeepEqual(values, test.expect) {
+			t.Errorf("%d: { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, values)
+		}
+		// streaming selects them all as well, as they're read
+		l := xml_lexer.Start(context.Background(), strings.NewReader(shop), tracer)
+		r, _ = pathExpr.Stream(l.Pipe, test.expr, l.Stop, nil, tracer)
+		if streamed := nodeValues(r); !reflect.DeepEqual(streamed, test.expect) {
+			t.Errorf("%d: streaming { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, streamed)
+		}
+	}
+
+	// the primitives the explanation gives, which find where a Path is
+	item := path.FindDescendant("item").FindNext("item")
+	el := pathExpr.ElementOf(path, item)
+	if el.Name() != "item" || el.Step(pathExpr.FollowingSibling, "price", nil).Contents().TextValue() != "5" {
+		t.Errorf("expected the ink's price, got %q, %q\n", el.Name(),
+			el.Step(pathExpr.FollowingSibling, "price", nil).Contents().TextValue())
+	}
+	if value := el.Parent().Contents().FindChild("price").TextValue(); value != "2" {
+		t.Errorf("expected the first price in the ink's order, got %q\n", value)
+	}
+	if value := el.StepMatching(pathExpr.PrecedingSibling, pathExpr.AnyName, nil).Contents().TextValue(); value != "2" {
+		t.Errorf("expected the nearest sibling before the ink, got %q\n", value)
+	}
+	if up := el.Parent().Parent().Parent(); up.Name() != "" || up.Parent().Contents() != nil {
+		t.Errorf("expected the document above the shop, and nothing above it, got %q\n", up.Name())
+	}
+	if copied := append(pathExpr.Path(nil), item...); pathExpr.ElementOf(path, copied).Contents() != nil {
+		t.Errorf("expected a copy not to be found\n")
+	}
+}
+
+// Comparisons compare as numbers when both sides are numbers, and as
+// strings otherwise, and the explanation says so
+func TestComparisons(t *testing.T) {
+	var tracer trace.Trace   // use stderr to trace
+	//tracer = trace.New(os.Stderr, true)
+	tracer = trace.New(ioutil.Discard, true) // and this to not
+
+	var orders = `{"orders": [` +
+		`{"id": "1", "price": "100", "status": "ok", "count": "3"}, ` +
+		`{"id": "2", "price": "250.5", "status": "late", "count": "12"}, ` +
+		`{"id": "3", "price": "9", "status": "ok", "count": "n/a"}, ` +
+		`{"id": "4", "price": "1e2", "status": "lost", "count": "0"}]}`
+	var tests = []struct {
+		expr   string
+		expect []string
+	}{
+		{ expr: "/orders[price>100]/id", expect: []string{"2"}},
+		{ expr: "/orders[price>=100]/id", expect: []string{"1", "2", "4"}},
+		{ expr: "/orders[price<10]/id", expect: []string{"3"}},
+		{ expr: `/orders[price="100.0"]/id`, expect: []string{"1", "4"}},
+		{ expr: `/orders[status!="ok"]/id`, expect: []string{"2", "4"}},
+		{ expr: `/orders[status<"m"]/id`, expect: []string{"2", "4"}},
+		{ expr: "/orders[count<=3]/id", expect: []string{"1", "4"}},
+		// n/a isn't a number, so it's compared as a string, and "n" > "3"
+		{ expr: "/orders[count>3]/id", expect: []string{"2", "3"}},
+		{ expr: "/orders[nothing!=1]/id", expect: nil},
+		{ expr: "//orders[price>1000]", expect: nil},
+	}
+	path := pathExpr.NewPath(json_lexer.Lex(orders, tracer), tracer)
+	for i, test := range tests {
+		r, err := pathExpr.MustCompile(test.expr).EvalTrace(path, tracer)
+		var values []string
+		for _, n := range r.Nodes {
+			values = append(values, n.Value)
+		}
+		if !reflect.DeepEqual(values, test.expect) {
+			t.Errorf("%d: { expr:%q, expect:%q }, got %q, %v\n", i, test.expr, test.expect, values, err)
+		}
+		var ambiguous *pathExpr.AmbiguousError
+		if errors.As(err, &ambiguous) && !strings.Contains(test.expr, `="`) {
+			t.Errorf("%d: only = looks up a key, so %q can't be ambiguous\n", i, test.expr)
+		}
+		// streaming selects them all as well, as they're read
+		l := json_lexer.Start(context.Background(), strings.NewReader(orders), tracer)
+		r, _ = pathExpr.Stream(l.Pipe, test.expr, l.Stop, nil, tracer)
+		if streamed := nodeValues(r); !reflect.DeepEqual(streamed, test.expect) {
+			t.Errorf("%d: streaming { expr:%q, expect:%q }, got %q\n", i, test.expr, test.expect, streamed)
+		}
+	}
+
+	// the explanation is the calls to make, and the rules they follow
+	var explanations = []struct {
+		expr   string
+		expect []string
+	}{
+		{ expr: "/orders[price>100]/id", expect: []string{
+			`.Step(pathExpr.Child, "orders", &pathExpr.Comparison{Name: "price", Op: ">", Value: "100"})`,
+			"greater than", "compared as numbers"}},
+		{ expr: `/orders[status!="ok"]`, expect: []string{"not equal to", "compared as strings"}},
+		{ expr: `/orders[id="2"]`, expect: []string{`.FindChildSuchThat("orders", "id", "2")`, "equal to", "the first match only"}},
+	}
+	for i, test := range explanations {
+		explanation := pathExpr.MustCompile(test.expr).Explain()
+		for _, expect := range test.expect {
+			if !strings.Contains(explanation, expect) {
+				t.Errorf("%d: expected the explanation of %q to have %q in it, got %q\n",
+					i, test.expr, expect, explanation)
+			}
+		}
+	}
+	if value := pathExpr.ElementOf(path, path).Step(pathExpr.Child, "orders",
+		&pathExpr.Comparison{Name: "count", Op: ">", Value: "10"}).Contents().FindChild("id").TextValue(); value != "2" {
+		t.Errorf("expected the order with 12, got %q\n", value)
+	}
 }
@@ -0,0 +1,6 @@
+package main
+
+import "syscall"
+
+// ioctlReadTermios is the ioctl that reads a terminal's settings
+const ioctlReadTermios = syscall.TCGETS
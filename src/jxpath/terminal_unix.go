@@ -0,0 +1,20 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal reports whether a file is an interactive terminal, rather
+// than a file or pipe with data to read. It asks for the terminal's
+// settings, as isatty does, since other character devices, such as
+// /dev/null, have data to read too, if none.
+func isTerminal(f *os.File) bool {
+	var settings syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlReadTermios,
+		uintptr(unsafe.Pointer(&settings)))
+	return errno == 0
+}
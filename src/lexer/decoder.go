@@ -0,0 +1,248 @@
+package lexer
+
+import (
+	"token"
+	"trace"
+
+	"context"
+	"fmt"
+)
+
+/*
+ * The scaffolding the decoders of json-like formats share. A msgpack or
+ * cbor value is a header, saying what it is, followed by what's in it,
+ * and the decoders turn it into the tokens the json lexer would give for
+ * the equivalent json: map keys become BEGIN names and each array
+ * element repeats its array's name. Only the headers differ between
+ * formats. XML-RPC and property lists are xml, so they're decoded into a
+ * Tree first, whose items serve as the headers.
+ *
+ * A scalar's type is lost, as it is for json: it's only text, formatted
+ * as the equivalent json literal, so a string "3" and a number 3 are the
+ * same value, as are a date and the string it's written as.
+ */
+
+// the kinds of item a header can start
+const (
+	Scalar = iota
+	Mapping
+	Array
+)
+
+// MaxDepth is how deeply maps and arrays may nest, so input made of
+// nothing but nested headers is an error, rather than a stack overflow
+const MaxDepth = 1000
+
+// Indefinite is the count of a map or array ended by a break, as cbor's
+// can be
+const Indefinite = -1
+
+// Item is a decoded header: either a scalar, already formatted as
+// text, or the start of a map or array of N entries.
+type Item struct {
+	Kind int
+	Text string
+	N    int
+}
+
+// Decoder is a json-like format, known by how its headers are decoded
+type Decoder struct {
+	Header func(l *Lexer) (Item, error)
+	Break  string // what ends an Indefinite map or array, if they can be
+}
+
+// Decode is the only state of a decoder's lexer: it decodes the one
+// value in the input
+func (d Decoder) Decode(l *Lexer) StateFn {
+	defer l.Begin()()
+
+	if err := d.top(l); err != nil {
+		l.Emit(token.ERROR, err.Error())
+	} else if l.Buffered() > 0 {
+		l.Emit(token.ERROR, fmt.Sprintf("%d bytes of trailing data", l.Buffered()))
+	} else {
+		l.Emit(token.EOF, "")
+	}
+	return nil
+}
+
+// Valid reports whether input is exactly one value, for use in guessing
+// the type of binary input
+func (d Decoder) Valid(input string) bool {
+	l := New(context.Background(), input, nil, trace.New(nil, false))
+	err := d.skip(l, 0)
+	return err == nil && l.Buffered() == 0
+}
+
+// Tree is a value decoded whole, rather than a header at a time: a
+// scalar, or a map or array of Values. A map's Keys name its Values, in
+// the same order.
+type Tree struct {
+	Item
+	Keys   []string
+	Values []Tree
+}
+
+// LexTree returns the tokens of a tree, the same as those of a value
+// decoded a header at a time, ending with an ERROR if ctx is cancelled
+func LexTree(ctx context.Context, tree Tree, tp trace.Trace) []token.Token {
+	items := tree.items(nil)
+	d := Decoder{Header: func(*Lexer) (Item, error) {
+		it := items[0]
+		items = items[1:]
+		return it, nil
+	}}
+	return Lex(ctx, "", d.Decode, tp)
+}
+
+// items appends the items of a tree in the order they'd be decoded as
+// headers, with each key an item before its value
+func (t Tree) items(items []Item) []Item {
+	it := t.Item
+	if it.Kind != Scalar {
+		it.N = len(t.Values)
+	}
+	items = append(items, it)
+	for i, v := range t.Values {
+		if t.Kind == Mapping {
+			items = append(items, Item{Kind: Scalar, Text: t.Keys[i]})
+		}
+		items = v.items(items)
+	}
+	return items
+}
+
+// top decodes the outermost value, which has no name. A map is
+// bracketed the way the json lexer brackets an unnamed {.
+func (d Decoder) top(l *Lexer) error {
+	defer l.Begin()()
+
+	it, err := d.Header(l)
+	if err != nil {
+		return err
+	}
+	switch it.Kind {
+	case Mapping:
+		l.Emit(token.BEGIN, "")
+		if err = d.entries(l, it.N, 1); err != nil {
+			return err
+		}
+		l.Emit(token.END, "<unnamed>")
+	case Array:
+		return d.elements(l, "", it.N, false, 1)
+	default:
+		l.Emit(token.VALUE, it.Text)
+	}
+	return nil
+}
+
+// element decodes a value as the contents of name. An array
+// emits one element per entry, all with the same name. Depth is how
+// many maps and arrays it's in.
+func (d Decoder) element(l *Lexer, name string, inArray bool, depth int) error {
+	if depth > MaxDepth {
+		return tooDeep()
+	}
+	it, err := d.Header(l)
+	if err != nil {
+		return err
+	}
+	switch it.Kind {
+	case Mapping:
+		l.Emit(token.BEGIN, name)
+		if err = d.entries(l, it.N, depth+1); err != nil {
+			return err
+		}
+		l.Emit(token.END, name)
+	case Array:
+		return d.elements(l, name, it.N, inArray, depth+1)
+	default:
+		l.Emit(token.BEGIN, name)
+		l.Emit(token.VALUE, it.Text)
+		l.Emit(token.END, name)
+	}
+	return nil
+}
+
+// elements decodes the n entries of an array called name. An array
+// in an array is wrapped in an element of its own, as is an empty one.
+func (d Decoder) elements(l *Lexer, name string, n int, inArray bool, depth int) error {
+	var wrapped = inArray || n == 0 || n == Indefinite && d.atBreak(l)
+
+	if wrapped {
+		l.Emit(token.BEGIN, name)
+	}
+	for i := 0; d.more(l, i, n); i++ {
+		if err := d.element(l, name, true, depth); err != nil {
+			return err
+		}
+	}
+	if wrapped {
+		l.Emit(token.END, name)
+	}
+	return nil
+}
+
+// entries decodes the n key-value pairs of a map
+func (d Decoder) entries(l *Lexer, n int, depth int) error {
+	for i := 0; d.more(l, i, n); i++ {
+		key, err := d.Header(l)
+		if err != nil {
+			return err
+		}
+		if key.Kind != Scalar {
+			return fmt.Errorf("map key is not a string or number")
+		}
+		if err = d.element(l, key.Text, false, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip decodes a value, depth maps and arrays deep, without emitting
+// anything
+func (d Decoder) skip(l *Lexer, depth int) error {
+	if depth > MaxDepth {
+		return tooDeep()
+	}
+	it, err := d.Header(l)
+	if err != nil {
+		return err
+	}
+	for i := 0; it.Kind != Scalar && d.more(l, i, it.N); i++ {
+		if err = d.skip(l, depth+1); err != nil {
+			return err
+		}
+		if it.Kind == Mapping {
+			if err = d.skip(l, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tooDeep is the error for maps and arrays nested more than MaxDepth deep
+func tooDeep() error {
+	return fmt.Errorf("maps and arrays are nested more than %d deep", MaxDepth)
+}
+
+// more reports whether there is an i'th entry in a map or array of n.
+// Indefinite ones continue until a break, which it consumes.
+func (d Decoder) more(l *Lexer, i, n int) bool {
+	if n != Indefinite {
+		return i < n
+	}
+	if d.atBreak(l) {
+		l.Take(len(d.Break))
+		return false
+	}
+	return true
+}
+
+// atBreak looks for the break that ends an indefinite item, without
+// advancing
+func (d Decoder) atBreak(l *Lexer) bool {
+	return d.Break != "" && l.HasPrefix(d.Break)
+}
@@ -8,34 +8,186 @@ import (
 
 	"unicode/utf8"
 	"unicode"
-	"strings"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"sync"
 )
 
 const eof = -1  // is this a good idea or unneeded complexity?
 		// FIXME figure out of empty strings are better than eofs
 
-// Lexer is the underlying data structure for the two language-specific lexers
+const chunk = 4096 // how much is read from a reader at a time
+
+// Lexer is the underlying data structure for the two language-specific lexers.
+// It reads from an io.Reader into a sliding buffer, which holds only the
+// current item and what's been looked ahead at, so lexing a large document
+// takes no more memory than lexing a small one. Cancelling its context,
+// or calling Stop, makes it see eof and drop whatever it would emit, so
+// its goroutine always finishes.
 type Lexer struct {
-	input string           // the string being scanned.
-	start int              // start position of this item.
-	pos   int              // current position in the input.
-	width int              // width of last rune read from input.
-	stack []string         // for begin-end matching
-	Pipe  chan token.Token // channel of parser.Tokens.
-	trace.Trace            // a composed-in tracer
-}
-
-// New creates a lexer struct
-func New(input string, pipe chan token.Token, tp trace.Trace) (*Lexer) {
-	var l = Lexer{input, 0, 0, 0, nil, pipe, tp}
+	input  []byte           // the part of the input being scanned.
+	reader io.Reader        // where the rest comes from, nil at the end
+	err    error            // why the reader stopped, if not at eof
+	mu     sync.Mutex       // guards err, which Err reads from the parser's goroutine
+	start  int              // start position of this item.
+	pos    int              // current position in the input.
+	width  int              // width of last rune read from input.
+	stack  []string         // for begin-end matching
+	ctx    context.Context  // the caller's, for cancellation and deadlines
+	done   <-chan struct{}  // closed by cancelling ctx, or by Stop
+	cancel context.CancelFunc // closes done
+	Pipe   chan token.Token // channel of parser.Tokens.
+	trace.Trace             // a composed-in tracer
+}
+
+// New creates a lexer struct for a string, all of which is buffered
+func New(ctx context.Context, input string, pipe chan token.Token, tp trace.Trace) (*Lexer) {
+	var l = Lexer{input: []byte(input), ctx: ctx, Pipe: pipe, Trace: tp}
+	l.cancellable(ctx)
+	return &l
+}
+
+// NewReader creates a lexer struct that reads its input as it goes
+func NewReader(ctx context.Context, r io.Reader, pipe chan token.Token, tp trace.Trace) (*Lexer) {
+	var l = Lexer{reader: r, ctx: ctx, Pipe: pipe, Trace: tp}
+	l.cancellable(ctx)
 	return &l
 }
 
+// cancellable sets up done, for the caller's context and for Stop
+func (l *Lexer) cancellable(ctx context.Context) {
+	ctx, l.cancel = context.WithCancel(ctx)
+	l.done = ctx.Done()
+}
+
+// Stop tells the lexer no more tokens are wanted, so it reads no further,
+// sees eof, and drops anything it would still emit. The parser calls it
+// when it's done, such as after an EOF or ERROR, so the lexer finishes
+// too. It may be called more than once.
+func (l *Lexer) Stop() {
+	l.cancel()
+}
+
+// stopped reports whether the lexer has been cancelled or stopped
+func (l *Lexer) stopped() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Err returns the error that stopped the reader, or the caller's context,
+// or nil if the lexer reached eof or was stopped
+func (l *Lexer) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return l.err
+	}
+	return l.ctx.Err()
+}
+
+// fill reads until there are at least n bytes after pos, or the reader
+// is exhausted. Before reading, it drops the items already emitted or
+// ignored, keeping the buffer no bigger than the current item needs.
+func (l *Lexer) fill(n int) bool {
+	for len(l.input) - l.pos < n && l.reader != nil && !l.stopped() {
+		if l.start > 0 && l.start >= len(l.input) / 2 {
+			l.input = l.input[:copy(l.input, l.input[l.start:])]
+			l.pos -= l.start
+			l.start = 0
+		}
+		if cap(l.input) - len(l.input) < chunk {
+			grown := make([]byte, len(l.input), 2 * cap(l.input) + chunk)
+			copy(grown, l.input)
+			l.input = grown
+		}
+		m, err := l.reader.Read(l.input[len(l.input):cap(l.input)])
+		l.input = l.input[:len(l.input) + m]
+		if err == io.EOF {
+			l.reader = nil
+		} else if err != nil {
+			l.reader = nil
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+		}
+	}
+	return len(l.input) - l.pos >= n
+}
+
+/*
+ * The scaffolding every lexer shares: a goroutine running state
+ * functions, and a null parser collecting their tokens
+ */
+
+// StateFn represents the state of the scanner
+// as a function that returns the next state.
+type StateFn func(*Lexer) StateFn
+
+// Start makes a lexer for r and runs it from the start state on a
+// goroutine of its own. Its Pipe carries the tokens, up to an EOF or
+// ERROR, unless it's stopped early or ctx is cancelled. Either way, Run
+// closes the Pipe and returns.
+func Start(ctx context.Context, r io.Reader, start StateFn, tp trace.Trace) *Lexer {
+	l := NewReader(ctx, r, make(chan token.Token), tp)
+	go l.Run(start) // closes pipe
+	return l
+}
+
+// Lex is the entry point for a lexer over a string: it runs the
+// states from start and returns all their tokens
+func Lex(ctx context.Context, input string, start StateFn, tp trace.Trace) []token.Token {
+	l := New(ctx, input, make(chan token.Token), tp)
+	go l.Run(start) // closes pipe
+	return l.Tokens()
+}
+
+// Run lexes the input by executing state functions until
+// the state is nil, then closes its output
+func (l *Lexer) Run(start StateFn) {
+	defer l.Begin()()
+
+	for state := start; state != nil; {
+		state = state(l)
+	}
+	close(l.Pipe)
+}
+
+// Tokens accepts the lexemes from Run and returns when it has them all,
+// up to an EOF or ERROR. Then it stops the lexer, which may have more to
+// say. If the reader failed or ctx was cancelled, the tokens end with an
+// ERROR saying so.
+func (l *Lexer) Tokens() []token.Token {
+	var slice []token.Token
+
+	defer l.Begin()()
+	for tok := range l.Pipe {
+		slice = append(slice, tok)
+		if tok.Typ == token.EOF || tok.Typ == token.ERROR {
+			l.Printf("at end, token = %s", tok)
+			break
+		}
+	}
+	l.Stop()
+	if err := l.Err(); err != nil {
+		// the reader failed or was cancelled, so the end is really an error
+		if n := len(slice); n > 0 && (slice[n-1].Typ == token.EOF || slice[n-1].Typ == token.ERROR) {
+			slice = slice[:n-1]
+		}
+		slice = append(slice, token.Token{Typ: token.ERROR, Val: err.Error()})
+	}
+	return slice
+}
+
 // String displays a minimal view of the Lexer FIXME
 func (l *Lexer) String() string {
 	return  fmt.Sprintf(
-		"{ input: %v\n" +
+		"{ input: %.40q\n" +
 		"  start: %d\n" +
 		"  pos: %d\n" +
 		"  width: %d\n" +
@@ -51,7 +203,7 @@ func (l *Lexer) AcceptQstring() string {
 	var s string
 
 	defer l.Begin()()
-	l.Printf("starting with %.40q ....\n",l.Rest())
+	l.Printf("starting with %q ....\n",l.Ahead(40))
 	l.Next()  // strip off "
 	l.Ignore()
 	for {
@@ -97,11 +249,17 @@ func (l *Lexer) AcceptVariableName() string {
 	return l.Current()
 }
 
-// Emit passes an item to the parser via the pipe.
+// Emit passes an item to the parser via the pipe, unless the
+// lexer has been stopped.
 func (l *Lexer) Emit(tt token.Type, s string) {
 	defer l.Begin(tt, s)()
 	value :=  token.Token{Typ: tt, Val:s}
-	l.Pipe <- value
+	if !l.stopped() {
+		select {
+		case l.Pipe <- value:
+		case <-l.done:
+		}
+	}
 	l.start = l.pos // advance to pos
 }
 
@@ -111,28 +269,58 @@ func (l *Lexer) Emit(tt token.Type, s string) {
 
 // Current returns the string we've collected to date
 func (l *Lexer) Current() string {
-	return l.input[l.start:l.pos]
+	return string(l.input[l.start:l.pos])
 }
 
-// Rest returns the remaining characters to be lexed, after pos.
+// Rest returns the remaining characters that have been read, after pos.
+// For a lexer made by New, that's all of them.
 func (l *Lexer) Rest() string {
-	return  l.input[l.pos:]
+	return  string(l.input[l.pos:])
+}
+
+// Ahead returns up to the next n characters, without advancing. Used
+// to show where a lexer is in traces.
+func (l *Lexer) Ahead(n int) string {
+	l.fill(n)
+	if n > len(l.input) - l.pos {
+		n = len(l.input) - l.pos
+	}
+	return string(l.input[l.pos:l.pos + n])
+}
+
+// Buffered returns how many bytes have been read after pos. For a
+// lexer made by New, that's how many are left.
+func (l *Lexer) Buffered() int {
+	return len(l.input) - l.pos
 }
 
 // Next returns the next rune, as an int
 // FIXME why not a rune? eof == -1, that's why...
 func (l *Lexer) Next() int {
 	var r rune
-	if l.pos >= len(l.input) {
+	l.fill(utf8.UTFMax)
+	if l.pos >= len(l.input) || l.stopped() {
 		l.width = 0
 		return eof
 	}
 	r, l.width =
-		utf8.DecodeRuneInString(l.Rest())
+		utf8.DecodeRune(l.input[l.pos:])
 	l.pos += l.width
 	return int(r)
 }
 
+// Take returns the next n bytes, for binary formats that don't consist
+// of runes. It returns false if there aren't n bytes left.
+func (l *Lexer) Take(n int) (string, bool) {
+	if n < 0 || !l.fill(n) || l.stopped() {
+		l.width = 0
+		return "", false
+	}
+	s := string(l.input[l.pos:l.pos + n])
+	l.pos += n
+	l.width = n
+	return s, true
+}
 
 // Ignore skips over the pending input before this point.
 func (l *Lexer) Ignore() {
@@ -153,7 +341,7 @@ func (l *Lexer) SkipOver() {
 	for {
 		nextc := l.Next()
 		if unicode.IsSpace(rune(nextc)) {
-			l.Printf("skipped whitespace %q\n", nextc)
+			l.Printf("skipped whitespace %q\n", rune(nextc))
 		} else if nextc == ',' {
 			l.Print("skipped comma\n")
 		} else {
@@ -191,6 +379,16 @@ func (l *Lexer) Pop() string {
 	return value
 }
 
+// Top returns the name on top of the stack, without popping it,
+// or "" if the stack is empty
+func (l *Lexer) Top() string {
+	length := len(l.stack)
+	if length < 1 {
+		return ""
+	}
+	return l.stack[length-1]
+}
+
 
 // HasPrefix looks for a string without advancing. Used only
 // in xml parse. Json uses pushback instead of lookahead.
@@ -198,5 +396,6 @@ func (l *Lexer) Pop() string {
 func (l *Lexer) HasPrefix(s string) bool {
 	defer l.Begin()()
 
-	return strings.HasPrefix(l.input[l.pos:], s)
+	l.fill(len(s))
+	return bytes.HasPrefix(l.input[l.pos:], []byte(s))
 }
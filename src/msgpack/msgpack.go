@@ -0,0 +1,200 @@
+// Package msgpack -- decoder for MessagePack, a binary peer of the json lexer.
+// It produces the same tokens the json lexer would for the equivalent json:
+// map keys become BEGIN names and each array element repeats its array's
+// name. Byte strings are base64-encoded into VALUEs.
+package msgpack
+
+import (
+	"token"
+	"trace"
+	"lexer"
+
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// decoder decodes msgpack by its headers
+var decoder = lexer.Decoder{Header: header}
+
+// Lex is the entry point to the msgpack decoder
+func Lex(input string, tp trace.Trace) []token.Token {
+	return LexContext(context.Background(), input, tp)
+}
+
+// LexContext decodes until done or until ctx is cancelled, when the
+// tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) []token.Token {
+	defer tp.Begin()()
+	return lexer.Lex(ctx, input, decoder.Decode, tp)
+}
+
+// Valid reports whether input is exactly one msgpack value, for use in
+// guessing the type of binary input
+func Valid(input string) bool {
+	return decoder.Valid(input)
+}
+
+// header decodes the type byte and whatever follows it, up to the
+// contents of a map or array
+func header(l *lexer.Lexer) (lexer.Item, error) {
+	b, ok := l.Take(1)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("unexpected end of input")
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.Itoa(int(c))}, nil
+	case c >= 0xe0:
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.Itoa(int(int8(c)))}, nil
+	case c <= 0x8f:
+		return count(l, lexer.Mapping, int(c&0x0f))
+	case c <= 0x9f:
+		return count(l, lexer.Array, int(c&0x0f))
+	case c <= 0xbf:
+		return str(l, int(c&0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return lexer.Item{Kind: lexer.Scalar, Text: "null"}, nil
+	case 0xc2:
+		return lexer.Item{Kind: lexer.Scalar, Text: "false"}, nil
+	case 0xc3:
+		return lexer.Item{Kind: lexer.Scalar, Text: "true"}, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := length(l, 1<<(c-0xc4))
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		return bin(l, n)
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := length(l, 1<<(c-0xc7))
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		return ext(l, n)
+	case 0xca:
+		u, err := unsigned(l, 4)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatFloat(
+			float64(math.Float32frombits(uint32(u))), 'g', -1, 32)}, err
+	case 0xcb:
+		u, err := unsigned(l, 8)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatFloat(
+			math.Float64frombits(u), 'g', -1, 64)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		u, err := unsigned(l, 1<<(c-0xcc))
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatUint(u, 10)}, err
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (c - 0xd0)
+		u, err := unsigned(l, size)
+		// sign-extend from the top bit of size bytes
+		shift := uint(64 - 8*size)
+		return lexer.Item{Kind: lexer.Scalar, Text: strconv.FormatInt(int64(u<<shift)>>shift, 10)}, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return ext(l, 1<<(c-0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := length(l, 1<<(c-0xd9))
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		return str(l, n)
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := length(l, 2<<(c-0xdc))
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		return count(l, lexer.Array, n)
+	case 0xde, 0xdf: // map 16, 32
+		n, err := length(l, 2<<(c-0xde))
+		if err != nil {
+			return lexer.Item{}, err
+		}
+		return count(l, lexer.Mapping, n)
+	}
+	return lexer.Item{}, fmt.Errorf("invalid type byte 0x%02x", c)
+}
+
+// count starts a map or array, rejecting counts the input can't hold
+func count(l *lexer.Lexer, kind, n int) (lexer.Item, error) {
+	if n > l.Buffered() {
+		return lexer.Item{}, fmt.Errorf("count %d is longer than the input", n)
+	}
+	return lexer.Item{Kind: kind, N: n}, nil
+}
+
+// str takes an n-byte string
+func str(l *lexer.Lexer, n int) (lexer.Item, error) {
+	s, ok := l.Take(n)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("string of %d bytes is longer than the input", n)
+	}
+	return lexer.Item{Kind: lexer.Scalar, Text: s}, nil
+}
+
+// bin takes n bytes of binary data, as base64
+func bin(l *lexer.Lexer, n int) (lexer.Item, error) {
+	s, ok := l.Take(n)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("binary of %d bytes is longer than the input", n)
+	}
+	return lexer.Item{Kind: lexer.Scalar, Text: base64.StdEncoding.EncodeToString([]byte(s))}, nil
+}
+
+// ext takes an extension type and n bytes of data. Timestamps, type -1,
+// are converted to RFC 3339; anything else is returned as base64.
+func ext(l *lexer.Lexer, n int) (lexer.Item, error) {
+	t, ok := l.Take(1)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("unexpected end of input")
+	}
+	s, ok := l.Take(n)
+	if !ok {
+		return lexer.Item{}, fmt.Errorf("extension of %d bytes is longer than the input", n)
+	}
+	if int8(t[0]) != -1 {
+		return lexer.Item{Kind: lexer.Scalar, Text: base64.StdEncoding.EncodeToString([]byte(s))}, nil
+	}
+	var sec, nsec int64
+	switch n {
+	case 4:
+		sec = int64(binary.BigEndian.Uint32([]byte(s)))
+	case 8:
+		u := binary.BigEndian.Uint64([]byte(s))
+		nsec, sec = int64(u>>34), int64(u&(1<<34-1))
+	case 12:
+		nsec = int64(binary.BigEndian.Uint32([]byte(s[:4])))
+		sec = int64(binary.BigEndian.Uint64([]byte(s[4:])))
+	default:
+		return lexer.Item{}, fmt.Errorf("timestamp of %d bytes", n)
+	}
+	return lexer.Item{Kind: lexer.Scalar, Text: time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano)}, nil
+}
+
+// length takes a big-endian length of size bytes
+func length(l *lexer.Lexer, size int) (int, error) {
+	u, err := unsigned(l, size)
+	if err == nil && u > uint64(l.Buffered()) {
+		err = fmt.Errorf("length %d is longer than the input", u)
+	}
+	return int(u), err
+}
+
+// unsigned takes a big-endian unsigned integer of size bytes
+func unsigned(l *lexer.Lexer, size int) (uint64, error) {
+	var u uint64
+
+	s, ok := l.Take(size)
+	if !ok {
+		return 0, fmt.Errorf("unexpected end of input")
+	}
+	for i := 0; i < size; i++ {
+		u = u<<8 | uint64(s[i])
+	}
+	return u, nil
+}
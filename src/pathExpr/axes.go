@@ -0,0 +1,250 @@
+package pathExpr
+
+import (
+	"token"
+	"trace"
+
+	"regexp"
+)
+
+/*
+ * The primitives that know the shape of a document: which elements are
+ * children of which. A Path they're given is the whole document, or the
+ * contents of one element, between its BEGIN and END. Unnamed elements,
+ * such as the braces around a json document, are transparent, so their
+ * children count as children of whatever they're in, and are never
+ * matched by a wildcard or pattern.
+ */
+
+// AnyName is the pattern of a * step, which matches any name
+var AnyName = regexp.MustCompile(`.`)
+
+// FindChild finds the first child element named target
+func (p Path) FindChild(target string) Path {
+	return p.first(p.find(Child, named(target), nil, untraced))
+}
+
+// FindDescendant finds the first element named target at any depth
+func (p Path) FindDescendant(target string) Path {
+	return p.first(p.find(Descendant, named(target), nil, untraced))
+}
+
+// FindNthDescendant finds the first element named target at any depth
+// that is the nth so named in the element it's in, counting from 1, as
+// //target[n] does
+func (p Path) FindNthDescendant(target string, n int) Path {
+	return p.first(p.find(Descendant, named(target), &Position{N: n}, untraced))
+}
+
+// FindChildSuchThat finds the first child element named target that has
+// a child tokenName whose text value equals desiredValue, as numbers if
+// both are numbers
+func (p Path) FindChildSuchThat(target, tokenName, desiredValue string) Path {
+	return p.first(p.find(Child, named(target), &Comparison{Name: tokenName, Op: "=", Value: desiredValue}, untraced))
+}
+
+// FindDescendantSuchThat is FindChildSuchThat at any depth
+func (p Path) FindDescendantSuchThat(target, tokenName, desiredValue string) Path {
+	return p.first(p.find(Descendant, named(target), &Comparison{Name: tokenName, Op: "=", Value: desiredValue}, untraced))
+}
+
+// FindChildMatching finds the first child element whose name re
+// matches, so AnyName finds the first child of any name. As with
+// MatchString, re has to be anchored to match whole names.
+func (p Path) FindChildMatching(re *regexp.Regexp) Path {
+	return p.first(p.find(Child, nameTest{re: re}, nil, untraced))
+}
+
+// FindDescendantMatching is FindChildMatching at any depth
+func (p Path) FindDescendantMatching(re *regexp.Regexp) Path {
+	return p.first(p.find(Descendant, nameTest{re: re}, nil, untraced))
+}
+
+// FindNthMatching finds the nth child element whose name re matches,
+// counting from 1
+func (p Path) FindNthMatching(re *regexp.Regexp, n int) Path {
+	return p.first(p.find(Child, nameTest{re: re}, &Position{N: n}, untraced))
+}
+
+// FindNthDescendantMatching is FindNthMatching at any depth, counting
+// in each element, as FindNthDescendant does
+func (p Path) FindNthDescendantMatching(re *regexp.Regexp, n int) Path {
+	return p.first(p.find(Descendant, nameTest{re: re}, &Position{N: n}, untraced))
+}
+
+// FindChildMatchingSuchThat finds the first child element whose name re
+// matches that has a child tokenName whose text value is desiredValue
+func (p Path) FindChildMatchingSuchThat(re *regexp.Regexp, tokenName, desiredValue string) Path {
+	return p.first(p.find(Child, nameTest{re: re}, &Comparison{Name: tokenName, Op: "=", Value: desiredValue}, untraced))
+}
+
+// FindDescendantMatchingSuchThat is FindChildMatchingSuchThat at any depth
+func (p Path) FindDescendantMatchingSuchThat(re *regexp.Regexp, tokenName, desiredValue string) Path {
+	return p.first(p.find(Descendant, nameTest{re: re}, &Comparison{Name: tokenName, Op: "=", Value: desiredValue}, untraced))
+}
+
+// nameTest is which names a step selects: the one name, or those a
+// pattern matches
+type nameTest struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// named is the test for a name alone
+func named(name string) nameTest {
+	return nameTest{name: name}
+}
+
+// matches reports whether an element's name passes the test. Unnamed
+// elements never match a pattern, as they're transparent, but the
+// document, which has no name either, is a node.
+func (nt nameTest) matches(name string) bool {
+	if nt.re == anyNode {
+		return true
+	}
+	if nt.re != nil {
+		return name != "" && nt.re.MatchString(name)
+	}
+	return name == nt.name
+}
+
+func (nt nameTest) String() string {
+	if nt.re == anyNode {
+		return "node()"
+	}
+	if nt.re != nil {
+		return "~" + nt.re.String()
+	}
+	return nt.name
+}
+
+// first returns the contents of the first element find found, or nil.
+// It has room to grow to the end of p, but no further, so FindNext can go
+// on to what follows it without leaving the element p is in.
+func (p Path) first(found []span) Path {
+	if len(found) == 0 {
+		return nil
+	}
+	return p[found[0].begin+1 : found[0].end : len(p)]
+}
+
+// span is where an element's BEGIN and END are in a path. An element
+// that isn't closed, as in input that's cut short, ends where the path
+// does.
+type span struct {
+	begin, end int
+}
+
+// find returns the elements on an axis from p whose names pass a test
+// and that satisfy a predicate, which may be nil, in document order
+func (p Path) find(axis Axis, target nameTest, pr Predicate, t trace.Trace) []span {
+	return p.findAll(axis, target, []Predicate{pr}, t)
+}
+
+// findAll is find with any number of predicates, each taken in turn on
+// what the one before it left, as [price>100][2] is the second of those
+// over 100. Positions count what's left in each parent, so on the
+// descendant axis there can be one nth in each.
+func (p Path) findAll(axis Axis, target nameTest, preds []Predicate, t trace.Trace) []span {
+	var found []span
+	var parents []int  // the BEGIN of the parent of each found, or -1
+	var at = []int{-1} // the last named BEGIN at each depth, or -1
+
+	defer t.Begin(axis, target, preds)()
+	ends, depths := p.shape()
+	for i, tok := range p {
+		if tok.Typ != token.BEGIN || tok.Val == "" {
+			continue
+		}
+		parent := at[depths[i]]
+		at = append(at[:depths[i]+1], i)
+		if !target.matches(tok.Val) || (axis == Child && depths[i] != 0) {
+			continue
+		}
+		sp := span{begin: i, end: ends[i]}
+		if sp.end < 0 {
+			sp.end = len(p)
+		}
+		found, parents = append(found, sp), append(parents, parent)
+	}
+	for _, pr := range preds {
+		found, parents = p.filter(found, parents, pr, t)
+	}
+	for _, sp := range found {
+		t.Printf("found p[%d:%d]\n", sp.begin, sp.end)
+	}
+	return found
+}
+
+// filter returns the spans in p that satisfy a predicate, and their
+// parents, keeping their order. Positions count in that order, among
+// the spans with the same parent.
+func (p Path) filter(found []span, parents []int, pr Predicate, t trace.Trace) (kept []span, keptParents []int) {
+	var n = make(map[int]int) // how many have been counted, by parent
+
+	for i, sp := range found {
+		switch pr := pr.(type) {
+		case *Position:
+			if n[parents[i]]++; n[parents[i]] != pr.N {
+				continue
+			}
+		case *Comparison:
+			if !p[sp.begin+1:sp.end].satisfies(pr, t) {
+				continue
+			}
+		}
+		kept, keptParents = append(kept, sp), append(keptParents, parents[i])
+	}
+	return kept, keptParents
+}
+
+// satisfies reports whether any child named in a comparison has a text
+// value that compares to its value as it says, see compare.go
+func (p Path) satisfies(pr *Comparison, t trace.Trace) bool {
+	ends, depths := p.shape()
+	for i, tok := range p {
+		if tok.Typ != token.BEGIN || tok.Val != pr.Name || depths[i] != 0 || ends[i] < 0 {
+			continue
+		}
+		if compare(p[i+1:ends[i]].textValue(t), pr.Op, pr.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// shape finds where each BEGIN's element ends, or -1 if it doesn't, and
+// how many named elements each token is in. ENDs are matched to BEGINs
+// by nesting alone, as the json lexer ends its unnamed outermost element
+// with an END named <unnamed>.
+func (p Path) shape() (ends, depths []int) {
+	var open []int // the BEGINs of the elements we're in
+
+	ends = make([]int, len(p))
+	depths = make([]int, len(p))
+	depth := 0
+	for i, tok := range p {
+		ends[i] = -1
+		depths[i] = depth
+		switch tok.Typ {
+		case token.BEGIN:
+			open = append(open, i)
+			if tok.Val != "" {
+				depth++
+			}
+		case token.END:
+			if len(open) == 0 {
+				// a stray end, as a FindNext can leave
+				continue
+			}
+			begin := open[len(open)-1]
+			open = open[:len(open)-1]
+			ends[begin] = i
+			if p[begin].Val != "" {
+				depth--
+			}
+			depths[i] = depth
+		}
+	}
+	return ends, depths
+}
@@ -0,0 +1,90 @@
+package pathExpr
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+ * How a predicate like [price>100] compares a child's text value with
+ * the value it's given. If both are numbers, they're compared as numbers,
+ * so 9 < 10 and 1.0 = 1. If either isn't, they're compared as strings,
+ * a byte at a time, so "10" < "9" isn't what happens to numbers, but
+ * "apple" < "banana" is. Spaces around a number don't stop it being one.
+ */
+
+// the comparison operators, and what they're called in explanations
+var operators = map[string]string{
+	"=":  "equal to",
+	"!=": "not equal to",
+	"<":  "less than",
+	"<=": "less than or equal to",
+	">":  "greater than",
+	">=": "greater than or equal to",
+}
+
+// compare reports whether value op literal holds, numerically if both
+// are numbers and otherwise as strings
+func compare(value, op, literal string) bool {
+	var c int
+
+	x, xok := number(value)
+	y, yok := number(literal)
+	switch {
+	case xok && yok && x < y:
+		c = -1
+	case xok && yok && x > y:
+		c = 1
+	case xok && yok:
+		c = 0
+	default:
+		c = strings.Compare(value, literal)
+	}
+
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// number parses a finite number, in decimal
+func number(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, "xX_") {
+		// not hex, nor with Go's underscores
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, false
+	}
+	return f, true
+}
+
+// Rule says in words what a comparison selects, and how it compares
+func (pr *Comparison) Rule() string {
+	var how string
+
+	if _, ok := number(pr.Value); ok {
+		how = "compared as numbers if the text is a number too, as " +
+			strconv.Quote(pr.Value) + " is, and otherwise as strings"
+	} else {
+		how = "compared as strings, a byte at a time, as " +
+			strconv.Quote(pr.Value) + " isn't a number"
+	}
+	return "[" + quoteName(pr.Name) + pr.Op + quote(pr.Value) + "] is true if any child " +
+		strconv.Quote(pr.Name) + " has a text value " + operators[pr.Op] + " " +
+		strconv.Quote(pr.Value) + ", " + how
+}
@@ -0,0 +1,243 @@
+package pathExpr
+
+import (
+	"token"
+	"trace"
+
+	"regexp"
+)
+
+/*
+ * Going up and sideways. A Path is only the contents of an element, a
+ * subslice that can't see what's around it, so the axes that leave an
+ * element need the whole document, and where the element is in it: an
+ * Element. Its parent is the nearest named element it's in, as unnamed
+ * ones are transparent, or failing that the document itself.
+ */
+
+// anyNode is the pattern of a . or .. step, which unlike AnyName also
+// matches the document, which has no name
+var anyNode = regexp.MustCompile(``)
+
+// Element is an element of a document, or the whole of one, which knows
+// where it is, so it can find its parent and siblings. The zero Element
+// is none, as a primitive's nil Path is.
+type Element struct {
+	tree *tree
+	span
+}
+
+// ElementOf finds the element of doc whose contents are p, a Path that a
+// primitive found in doc, or doc itself. It can't find a Path copied
+// from doc, or one from a document parsed out of it, and returns the
+// zero Element.
+func ElementOf(doc, p Path) Element {
+	if cap(p) == 0 {
+		return Element{}
+	}
+	first := &p[:1][0]
+	for i := range doc {
+		if &doc[i] != first {
+			continue
+		}
+		tr := newTree(doc)
+		sp := tr.element(i - 1)
+		if i > 0 && (doc[i-1].Typ != token.BEGIN || sp.end != i+len(p)) {
+			// p starts in doc, but isn't an element's contents
+			return Element{}
+		}
+		return Element{tr, sp}
+	}
+	return Element{}
+}
+
+// Contents returns what's in the element, between its BEGIN and END,
+// as the primitives that find it would
+func (el Element) Contents() Path {
+	if el.tree == nil {
+		return nil
+	}
+	return el.tree.contents(el.span)
+}
+
+// Name returns the element's name, which is empty for a document
+func (el Element) Name() string {
+	if el.tree == nil {
+		return ""
+	}
+	return el.tree.name(el.span)
+}
+
+// Parent returns the element this one is in, or the document if it's
+// in none, or the zero Element if it's the document
+func (el Element) Parent() Element {
+	if el.tree == nil {
+		return Element{}
+	}
+	if sp, ok := el.tree.parent(el.span); ok {
+		return Element{el.tree, sp}
+	}
+	return Element{}
+}
+
+// Step finds the first element named name on an axis from this one that
+// satisfies the predicates, if any, each taken in turn on what the one
+// before it left, as a step's do. A nil predicate is none. On the
+// ancestor and preceding-sibling axes, the first is the nearest, and
+// positions count back from this element.
+func (el Element) Step(axis Axis, name string, preds ...Predicate) Element {
+	return el.step(axis, named(name), preds)
+}
+
+// StepMatching is Step for elements whose names re matches
+func (el Element) StepMatching(axis Axis, re *regexp.Regexp, preds ...Predicate) Element {
+	return el.step(axis, nameTest{re: re}, preds)
+}
+
+// step is Step with any test of names
+func (el Element) step(axis Axis, test nameTest, preds []Predicate) Element {
+	if el.tree == nil {
+		return Element{}
+	}
+	found := el.tree.axis(el.span, axis, test, preds, untraced)
+	if len(found) == 0 {
+		return Element{}
+	}
+	if axis == Ancestor || axis == PrecedingSibling {
+		return Element{el.tree, found[len(found)-1]}
+	}
+	return Element{el.tree, found[0]}
+}
+
+// tree is a document and its shape, so what's around each element in it
+// can be found
+type tree struct {
+	p      Path
+	ends   []int // where each BEGIN's element ends, or -1
+	depths []int // how many named elements each token is in
+}
+
+// newTree works out the shape of a document
+func newTree(p Path) *tree {
+	ends, depths := p.shape()
+	return &tree{p: p, ends: ends, depths: depths}
+}
+
+// element returns the span of the element that begins at i, or of the
+// whole document if i is -1
+func (tr *tree) element(i int) span {
+	if i < 0 {
+		return span{begin: -1, end: len(tr.p)}
+	}
+	if tr.ends[i] < 0 {
+		return span{begin: i, end: len(tr.p)}
+	}
+	return span{begin: i, end: tr.ends[i]}
+}
+
+// contents returns what's in an element, with room for its END, so an
+// empty element's contents can still be found in the document
+func (tr *tree) contents(sp span) Path {
+	if sp.end < len(tr.p) {
+		return tr.p[sp.begin+1 : sp.end : sp.end+1]
+	}
+	return tr.p[sp.begin+1 : sp.end : sp.end]
+}
+
+// name returns an element's name, or "" for the document
+func (tr *tree) name(sp span) string {
+	if sp.begin < 0 {
+		return ""
+	}
+	return tr.p[sp.begin].Val
+}
+
+// parent returns the named element sp is in, or the document, and false
+// if sp is the document. It's the last named element to begin before sp
+// one level up, as any others at that level have ended.
+func (tr *tree) parent(sp span) (span, bool) {
+	if sp.begin < 0 {
+		return span{}, false
+	}
+	depth := tr.depths[sp.begin]
+	for i := sp.begin - 1; i >= 0 && depth > 0; i-- {
+		if tr.p[i].Typ == token.BEGIN && tr.p[i].Val != "" && tr.depths[i] == depth-1 {
+			return tr.element(i), true
+		}
+	}
+	return tr.element(-1), true
+}
+
+// axis returns the elements on an axis from sp whose names pass a test
+// and that satisfy the predicates, each in turn, in document order. It
+// uses findAll for the axes that go down or along.
+func (tr *tree) axis(sp span, axis Axis, test nameTest, preds []Predicate, t trace.Trace) []span {
+	var found []span
+
+	defer t.Begin(axis, test, preds)()
+	switch axis {
+	case Child, Descendant:
+		return shift(tr.contents(sp).findAll(axis, test, preds, t), sp.begin+1)
+
+	case FollowingSibling:
+		parent, ok := tr.parent(sp)
+		if !ok || sp.end >= len(tr.p) {
+			// nothing follows the document, or an element cut short
+			return nil
+		}
+		return shift(tr.p[sp.end+1:parent.end].findAll(Child, test, preds, t), sp.end+1)
+	}
+
+	// preceding siblings, self, parent and ancestors, nearest first
+	var candidates []span
+	switch axis {
+	case PrecedingSibling:
+		parent, ok := tr.parent(sp)
+		if !ok {
+			return nil
+		}
+		candidates = tr.p[parent.begin+1:sp.begin].find(Child, test, nil, t)
+		candidates = reverse(shift(candidates, parent.begin+1))
+	case Self:
+		candidates = []span{sp}
+	case Parent:
+		if parent, ok := tr.parent(sp); ok {
+			candidates = []span{parent}
+		}
+	case Ancestor:
+		for parent, ok := tr.parent(sp); ok; parent, ok = tr.parent(parent) {
+			candidates = append(candidates, parent)
+		}
+	}
+	for _, c := range candidates {
+		if test.matches(tr.name(c)) {
+			found = append(found, c)
+		}
+	}
+	// all on one axis, so counted together
+	parents := make([]int, len(found))
+	for _, pr := range preds {
+		found, parents = tr.p.filter(found, parents, pr, t)
+	}
+	return reverse(found)
+}
+
+// shift moves spans found within a slice of a path to where they are in
+// the path
+func shift(found []span, by int) []span {
+	for i := range found {
+		found[i].begin += by
+		found[i].end += by
+	}
+	return found
+}
+
+// reverse reverses spans in place, as between document order and
+// nearest first
+func reverse(found []span) []span {
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
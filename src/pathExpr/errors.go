@@ -0,0 +1,65 @@
+package pathExpr
+
+import (
+	"fmt"
+)
+
+/*
+ * What an evaluation can go wrong with. A SyntaxError, in parse.go, stops
+ * an expression compiling; the others say what became of evaluating it.
+ * None of them are printed here: that's up to the caller.
+ */
+
+// NotFoundError reports a step that selected nothing, as distinct from a
+// selection that was found but has no text
+type NotFoundError struct {
+	Expression string
+	Step       string // the step, as in galaxy[world="venus"]
+	Pos        int    // where it starts in the expression, from 0
+}
+
+func (e *NotFoundError) Error() string {
+	return fmt.Sprintf("path expression %q selected nothing, as no %s was found at column %d",
+		e.Expression, e.Step, column(e.Expression, e.Pos))
+}
+
+// AmbiguousError reports a step with a name=value predicate that more
+// than one child of the same element satisfies, as when looking up a key
+// that isn't unique. All of them are selected, so the result comes with
+// the error, and can be used if that was what was wanted.
+type AmbiguousError struct {
+	Expression string
+	Step       string
+	Pos        int
+}
+
+func (e *AmbiguousError) Error() string {
+	return fmt.Sprintf("path expression %q is ambiguous, as more than one %s was found at column %d",
+		e.Expression, e.Step, column(e.Expression, e.Pos))
+}
+
+// Warning is something about an evaluation that may be legitimate, but
+// may also be due to an error in the input
+type Warning struct {
+	Pos int // where the step it's about starts, from 0
+	Msg string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("column %d: %s", w.Pos+1, w.Msg)
+}
+
+// Node is an element an evaluation selected
+type Node struct {
+	Name  string // empty for a whole document, as parse() selects
+	Value string // its text value, as TextValue gives
+	Path  Path   // its contents, to evaluate more expressions against
+}
+
+// Result is the nodes an evaluation selected, in document order, with
+// any warnings about them
+type Result struct {
+	Nodes    []Node
+	Value    string // the first node's value, or "" if there's none
+	Warnings []Warning
+}
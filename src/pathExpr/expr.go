@@ -0,0 +1,104 @@
+package pathExpr
+
+import (
+	"trace"
+
+	"fmt"
+)
+
+// Expr is a compiled path expression. It isn't changed once compiled, so
+// one can be evaluated against any number of paths, from any number of
+// goroutines, without parsing it again.
+type Expr struct {
+	expression  string
+	path        *LocationPath
+	explanation string
+}
+
+// Compile parses a path expression into an Expr
+func Compile(expression string) (*Expr, error) {
+	var doc, chain = "path", "path"
+	var rules string
+
+	lp, err := ParseExpr(expression)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range lp.Steps {
+		// record how we'd do the step
+		chain = recordStep(st, doc, chain)
+		if st.Parse {
+			doc = chain
+		}
+		// and say how its comparisons compare
+		for _, pr := range st.Predicates {
+			if pr, ok := pr.(*Comparison); ok {
+				rules += "\n\t// " + pr.Rule()
+			}
+		}
+	}
+	return &Expr{expression: expression, path: lp, explanation: "path := pathExpr.NewPath(lexer.Lex(input)); " +
+		"value := " + chain + ".TextValue()" + rules +
+		"\n\t// the first match only: each call finds the first element its step selects, where Eval selects them all"}, nil
+}
+
+// MustCompile is Compile for expressions known to be good, such as
+// constants, and panics if one isn't
+func MustCompile(expression string) *Expr {
+	e, err := Compile(expression)
+	if err != nil {
+		panic(fmt.Sprintf("pathExpr.MustCompile: %v", err))
+	}
+	return e
+}
+
+// String returns the expression as it was compiled
+func (e *Expr) String() string {
+	return e.expression
+}
+
+// Explain returns the calls to the primitives that find the first
+// element the expression selects, for an engineer to copy, followed by
+// a comment on how each comparison in it compares. The primitives find
+// only the first, so for all of them, as Eval returns, use Eval.
+func (e *Expr) Explain() string {
+	return e.explanation
+}
+
+// Eval evaluates the expression against a path, returning all the nodes
+// it selects. The error is nil, a NotFoundError if a step selected
+// nothing, or an AmbiguousError if a comparison was satisfied more than
+// once, which comes with the result. The result is never nil, so its
+// warnings can be read whatever the error.
+func (e *Expr) Eval(p Path) (*Result, error) {
+	return e.EvalTrace(p, untraced)
+}
+
+// EvalTrace is Eval, tracing to t. Each evaluation has its own trace, so
+// ones running at once don't mix their traces.
+func (e *Expr) EvalTrace(p Path, t trace.Trace) (*Result, error) {
+	defer t.Begin(e.expression)()
+	t.Printf("parse=%s\n", e.path)
+
+	r, err := e.run(p, t)
+	if r == nil {
+		return &Result{}, err
+	}
+	return r, err
+}
+
+// run does the steps on a document, returning a nil result if one
+// selects nothing
+func (e *Expr) run(p Path, t trace.Trace) (*Result, error) {
+	var ev = evaluation{expression: e.expression, t: t, docs: []Path{p}}
+	var last *Step
+
+	nodes, err := ev.steps([]node{{0, span{begin: -1, end: len(p)}}}, e.path.Steps)
+	if nodes == nil {
+		return nil, err
+	}
+	if n := len(e.path.Steps); n > 0 {
+		last = e.path.Steps[n-1]
+	}
+	return ev.result(nodes, last), err
+}
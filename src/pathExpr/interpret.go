@@ -3,217 +3,281 @@ package pathExpr
 import (
 	"trace"
 
-	"strings"
 	"fmt"
-	"os"
-	"unicode"
-	"unicode/utf8"
+	"sort"
 	"strconv"
 )
-var t trace.Trace
 
 // Interpreter reads a string like /universe/world or /match[opponent="fred"]
-// and return either a value or an explanation. For learning purposes, this
-// is a non-lexing string-walk.
-func (p Path) Interpreter(expression string, t trace.Trace, returnExplanation ...bool) string {
-	var elementName, expressionName, expressionValue string
-	var previousElement = ""
-	var parseThusFar = "/"  // for error reporting
-	var i int
-	var explanation = "path := pathExpr.NewPath(lexer.Lex(input)); value := path"
-	var explain = false
+// and returns what it selects. The expression is parsed into a tree
+// first, see parse.go, so a mistake in it is returned as a SyntaxError
+// with a caret under where it was found. A step of parse(), parse(json) or
+// parse(xml) re-lexes the value selected so far, so
+// /event/payload/parse()/id can look inside a document embedded in a string.
+// To evaluate an expression more than once, or to explain it, Compile it
+// instead.
+func (p Path) Interpreter(expression string, t trace.Trace) (*Result, error) {
 	defer t.Begin(expression)()
 
-	for _, x := range returnExplanation {
-	     explain = x
+	e, err := Compile(expression)
+	if err != nil {
+		return &Result{}, err
 	}
-	// if a value is not passed in, explain will remain false
+	t.Printf("explanation=%s\n", e.Explain())
+	return e.EvalTrace(p, t)
+}
 
-	// Trim any trailing slashes and spaces
-	var length = len(expression)
-	if strings.HasPrefix(expression[length-1:length], "/") {
-		// remove the /
-		expression = expression[:length-1]
-	}
-	for i = 0; i < len(expression); i++ {
-		//t.Printf("i=%d, %s\n", i, expression[i:])
-		if strings.HasPrefix(expression[i:], "/") {
-			// it's a new component
-			if i != 0 {
-				// record all non-empty steps for diagostics
-				parseThusFar += recordParse(elementName, expressionName, expressionValue, previousElement)
-				parseThusFar += "/"
+// the Go names of the axes, for the steps that need an Element
+var axisNames = map[Axis]string{
+	Child:            "pathExpr.Child",
+	Descendant:       "pathExpr.Descendant",
+	Self:             "pathExpr.Self",
+	Parent:           "pathExpr.Parent",
+	Ancestor:         "pathExpr.Ancestor",
+	FollowingSibling: "pathExpr.FollowingSibling",
+	PrecedingSibling: "pathExpr.PrecedingSibling",
+}
 
-				// record how we'd do the step
-				explanation += recordStep(elementName, expressionName, expressionValue, previousElement)
+// recordStep returns the calls that do a step after those in chain, on
+// the document doc. The axes that go up or sideways, comparisons other
+// than =, and more than one predicate need an Element, so they find it
+// in doc, and go on from its contents.
+func recordStep(st *Step, doc, chain string) string {
+	// parse(format)
+	if st.Parse {
+		return chain + `.Parse("` + st.Format + `")`
+	}
 
-				// and then execute them
-				p = doStep(p, elementName, expressionName, expressionValue, previousElement)
+	// a name, or for * and ~"regex", the pattern to match names with
+	var axis, name, matching = "Child", strconv.Quote(st.Name), ""
+	if st.Axis == Descendant {
+		axis = "Descendant"
+	}
+	switch {
+	case st.Pattern == anyNode && st.Axis == Self:
+		// .
+		return chain
+	case st.Pattern == anyNode:
+		// ..
+		return `pathExpr.ElementOf(` + doc + `, ` + chain + `).Parent().Contents()`
+	case st.Pattern == AnyName:
+		name, matching = "pathExpr.AnyName", "Matching"
+	case st.Pattern != nil:
+		name, matching = "regexp.MustCompile("+strconv.Quote(st.Pattern.String())+")", "Matching"
+	}
+	var element = st.Axis != Child && st.Axis != Descendant || len(st.Predicates) > 1
+	if pr, ok := predicate(st).(*Comparison); ok && pr.Op != "=" {
+		element = true
+	}
+	if element {
+		// following-sibling::componentName, componentName[expressionName>expressionValue],
+		// componentName[expressionName=expressionValue][2] and the like
+		var preds string
+		for _, pr := range st.Predicates {
+			switch p := pr.(type) {
+			case *Comparison:
+				preds += `, &pathExpr.Comparison{Name: ` + strconv.Quote(p.Name) + `, Op: ` +
+					strconv.Quote(p.Op) + `, Value: ` + strconv.Quote(p.Value) + `}`
+			case *Position:
+				preds += `, &pathExpr.Position{N: ` + strconv.Itoa(p.N) + `}`
 			}
-			previousElement = elementName
-			elementName, expressionName, expressionValue = "", "", ""
-
-		} else if strings.HasPrefix(expression[i:], "[") {
-			// it's an expression
-			var count int
-			count, expressionName, expressionValue = p.expressionEval(expression[i+1:])
-			i += count +1
-
-		} else {
-			// it's part of the component's name
-			elementName += expression[i:i + 1]
 		}
+		return `pathExpr.ElementOf(` + doc + `, ` + chain + `).Step` + matching + `(` +
+			axisNames[st.Axis] + `, ` + name + preds + `).Contents()`
+	}
+	switch pr := predicate(st).(type) {
+	case *Comparison:
+		// componentName[expressionName=expressionValue]
+		return chain + `.Find` + axis + matching + `SuchThat(` + name + `, ` +
+			strconv.Quote(pr.Name) + `, ` + strconv.Quote(pr.Value) + `)`
+	case *Position:
+		// componentName[2]
+		if st.Axis == Descendant {
+			return chain + `.FindNthDescendant` + matching + `(` + name + `, ` + strconv.Itoa(pr.N) + `)`
+		}
+		return chain + `.FindNth` + matching + `(` + name + `, ` + strconv.Itoa(pr.N) + `)`
 	}
-	// Add the current component to the parse
-	parseThusFar +=  recordParse(elementName, expressionName, expressionValue,
-		previousElement)
 
-	// execute the last step
-	p = doStep(p, elementName, expressionName, expressionValue, previousElement)
+	// componentName
+	return chain + `.Find` + axis + matching + `(` + name + `)`
+}
+
+// test returns the test a step's names have to pass
+func (st *Step) test() nameTest {
+	return nameTest{name: st.Name, re: st.Pattern}
+}
 
-	// get the value of the last element
-	result := p.TextValue()
+// evaluation is what's known while evaluating an expression once. It's
+// all that an evaluation changes, so evaluations can run concurrently.
+type evaluation struct {
+	expression string
+	t          trace.Trace
+	docs       []Path  // the input, and any documents parsed out of it
+	trees      []*tree // their shapes, once they're needed
+}
 
-	// explain
-	explanation += recordStep(elementName, expressionName, expressionValue,
-		previousElement) + ".TextValue()"
+// node is an element of one of an evaluation's documents. A whole
+// document is a node too, from before its start to its end.
+type node struct {
+	doc  int
+	span
+}
 
-	// and then report
-	t.Printf("parse=%s\n", parseThusFar)
-	t.Printf("explanation=%s\n", explanation)
-	if explain {
-		// Write it to stdout for the engineer to copy
-		fmt.Fprintf(os.Stderr, "explanation: %s\n", explanation)
+// tree returns the shape of one of the documents, working it out the
+// first time it's needed
+func (ev *evaluation) tree(doc int) *tree {
+	for len(ev.trees) <= doc {
+		ev.trees = append(ev.trees, nil)
 	}
-	return result
+	if ev.trees[doc] == nil {
+		ev.trees[doc] = newTree(ev.docs[doc])
+	}
+	return ev.trees[doc]
 }
 
-func (p Path) expressionEval(s string) (int, string, string) {
-	var i int
-	var name, value string
-	var inVal = false
-	defer t.Begin(s)()
-
-	r, _:= utf8.DecodeRuneInString(s[0:1])
-	if unicode.IsDigit(r) {
-		// it's a numbed selection, a special case
-		for i = 0; i < len(s); i++ {
-			//t.Printf("i=%d, %s\n", i, s[i:])
-			if strings.HasPrefix(s[i:], "]") {
-				// we're done
-				break
-			}
-			if r, _:= utf8.DecodeRuneInString(s[0:1]); unicode.IsDigit(r) {
-				value += s[i:i + 1]
-			} else {
-				fmt.Fprintf(os.Stderr, "Warning, %q is not a number, so " +
-					"this selection expressions is invalid, and the " +
-					"result may be wrong due to this error in the input, %s\n",
-					s[0:1], s)
-				// ignore value
+// contents returns what's in a node, between its BEGIN and END
+func (ev *evaluation) contents(n node) Path {
+	return ev.tree(n.doc).contents(n.span)
+}
+
+// step does a step from each of the nodes selected so far, in turn, so
+// a position or comparison is taken among the children, or whatever is
+// on the step's axis, of each one.
+// It returns the nodes selected, in document order, and a NotFoundError
+// if there are none, or an AmbiguousError if a comparison was satisfied
+// by more than one child of the same node.
+func (ev *evaluation) step(from []node, st *Step) ([]node, error) {
+	var selected []node
+	var ambiguous error
+
+	defer ev.t.Begin(st, len(from))()
+	for _, n := range from {
+		// parse(format)
+		if st.Parse {
+			if doc := ev.contents(n).parse(st.Format, ev.t); doc != nil {
+				ev.docs = append(ev.docs, doc)
+				selected = append(selected, node{len(ev.docs) - 1, span{begin: -1, end: len(doc)}})
 			}
+			continue
 		}
-		name = ""
-		t.Printf("i = %d, name=%s, value=%s", i, name, value)
-		return i, name, value
-	}
-
-	// Otherwise it's a name=value expression
-	for i = 0; i < len(s); i++ {
-		//ft.Printf("i=%d, %s\n", i, s[i:])
-		if strings.HasPrefix(s[i:], "=") {
-			inVal = true
-
-		} else if strings.HasPrefix(s[i:], "]") {
-			// we're done
-			break
-
-		} else if strings.HasPrefix(s[i:], "\"") {
-			// do nothing and thus skip the quote
-
-		} else {
-			if inVal == true {
-				// if text, it's the component's value
-				value += s[i:i + 1]
-			} else {
-				// or name
-				name += s[i:i + 1]
-			}
+
+		// componentName, componentName[2] or
+		// componentName[expressionName=expressionValue], on an axis
+		found := ev.tree(n.doc).axis(n.span, st.Axis, st.test(), st.Predicates, ev.t)
+		if pr, ok := predicate(st).(*Comparison); ok && pr.Op == "=" && len(found) > 1 && st.Axis != Ancestor {
+			ambiguous = &AmbiguousError{Expression: ev.expression, Step: st.String(), Pos: st.Pos}
+		}
+		for _, sp := range found {
+			selected = append(selected, node{n.doc, sp})
 		}
 	}
-	return i, name, value
-}
-
-func recordStep(componentName, expressionName, expressionValue, previousComponent string) string {
-	if componentName == "" {
-		// The expression contained a trailing slash, drop it
-		return ""
+	if len(selected) == 0 {
+		return nil, ev.notFound(st)
 	}
-
-	// componentName[expressionName=expressionValue]
-	if expressionName != "" {
-		return `.FindSuchThat("` + componentName + `", "` +
-			expressionName + `", "` + expressionValue +`")`
+	if len(from) > 1 {
+		// nodes within nodes, or beside them, can find the same ones, or
+		// out of order
+		selected = inOrder(selected)
 	}
+	return selected, ambiguous
+}
 
-	// componentName[2]
-	if expressionValue != "" {
-		return `.FindNth("` + componentName + `", "` +
-			  expressionValue +`")`
-	}
+// steps does steps in turn from nodes, returning what the last selects,
+// or nil and a NotFoundError if one selects nothing. The error is an
+// AmbiguousError if a comparison was satisfied more than once on the way.
+func (ev *evaluation) steps(nodes []node, steps []*Step) ([]node, error) {
+	var ambiguous error
 
-	// fcomponentName
-	return `.FindFirst("` + componentName + `")`
+	for _, st := range steps {
+		selected, err := ev.step(nodes, st)
+		if selected == nil {
+			return nil, err
+		}
+		if err != nil {
+			ambiguous = err
+		}
+		nodes = selected
+	}
+	return nodes, ambiguous
 }
 
-// do a step
-func doStep(path Path, componentName, expressionName, expressionValue, previousComponent string) Path {
-	if componentName == "" {
-		// The expression contained a trailing slash, ignore it (old?)
-		return path // unchanged
+// inOrder sorts nodes into document order, without duplicates
+func inOrder(nodes []node) []node {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].doc != nodes[j].doc {
+			return nodes[i].doc < nodes[j].doc
+		}
+		return nodes[i].begin < nodes[j].begin
+	})
+	var unique = nodes[:0]
+	for i, n := range nodes {
+		if i == 0 || n != nodes[i-1] {
+			unique = append(unique, n)
+		}
 	}
+	return unique
+}
 
-	// componentName[expressionName=expressionValue]
-	if expressionName != "" {
-		path = path.FindSuchThat(componentName, expressionName,
-			expressionValue)
-		//t.Printf("ran FindSuchThat(%s, %s, %s), got %s\n",
-		//	componentName, expressionName, expressionValue, path)
-		return path
-	}
+// result takes the names and text values of the nodes selected, with
+// any warnings about them
+func (ev *evaluation) result(nodes []node, last *Step) *Result {
+	var r Result
 
-	// componentName[2]
-	if expressionValue != "" {
-		i, _ := strconv.Atoi(expressionValue)
-		path = path.FindNth(componentName, i)
-		t.Printf("ran FindNth(%s, %d), got %s\n",
-			componentName, i, path)
-		return path
+	for _, n := range nodes {
+		p := ev.contents(n)
+		r.Nodes = append(r.Nodes, Node{Name: ev.tree(n.doc).name(n.span), Value: p.textValue(ev.t), Path: p})
 	}
-
-	//componentName
-	path = path.FindFirst(componentName)
-	//t.Printf("ran .FindFirst(%s), got %s\n", componentName, path)
-	return path
+	r.Value, r.Warnings = r.Nodes[0].Value, warnings(r.Nodes, last)
+	return &r
 }
 
+// warnings warns if the nodes the last step selected are all blank, or
+// if any has more than one text value
+func warnings(nodes []Node, last *Step) []Warning {
+	var warnings []Warning
+	var pos, blank, joined int
 
-func recordParse(componentName, expressionName, expressionValue, previousComponent string) string {
-	var parse = componentName
-
-	if componentName == "" {
-		return ""
+	warn := func(format string, v ...interface{}) {
+		warnings = append(warnings, Warning{Pos: pos, Msg: fmt.Sprintf(format, v...)})
 	}
-
-	if expressionName != "" {
-		parse += "[" + expressionName + `="` + expressionValue + `"]`
-		return parse
+	if last != nil {
+		pos = last.Pos
 	}
-
-	if expressionValue != "" {
-		parse += "[" + expressionValue + "]"
-		return parse
+	for _, n := range nodes {
+		switch texts := n.Path.texts(); {
+		case texts == 0:
+			blank++
+		case texts > 1:
+			joined++
+		}
+	}
+	if blank == len(nodes) {
+		warn("selected no non-blank text. The result may be legitimately " +
+			"blank, but it can also be wrong due to an error in the input")
 	}
+	switch {
+	case len(nodes) == 1 && joined > 0:
+		warn("selected %d text values, joined with spaces. The result may " +
+			"be legitimately multiple, but it can also be wrong due to an error in the input",
+			nodes[0].Path.texts())
+	case joined > 0:
+		warn("selected %d of %d nodes with more than one text value, each joined with " +
+			"spaces. They may be legitimately multiple, but can also be wrong due to an error " +
+			"in the input", joined, len(nodes))
+	}
+	return warnings
+}
 
-	return parse
+// notFound makes the error for a step that selected nothing
+func (ev *evaluation) notFound(st *Step) error {
+	return &NotFoundError{Expression: ev.expression, Step: st.String(), Pos: st.Pos}
+}
+
+// predicate returns a step's last predicate, which has the last word on
+// what it selects, or nil if it hasn't one
+func predicate(st *Step) Predicate {
+	if len(st.Predicates) == 0 {
+		return nil
+	}
+	return st.Predicates[len(st.Predicates)-1]
 }
@@ -0,0 +1,597 @@
+package pathExpr
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+ * The path language, parsed into a tree by recursive descent:
+ *
+ *	path      := [ "/" | "//" ] [ step { ( "/" | "//" ) step } [ "/" ] ]
+ *	step      := "parse" "(" [ "json" | "xml" ] ")" | "." | ".." |
+ *	             [ axis "::" ] nametest { predicate }
+ *	axis      := "child" | "descendant" | "self" | "parent" | "ancestor" |
+ *	             "following-sibling" | "preceding-sibling"
+ *	nametest  := "*" | "~" string | name
+ *	predicate := "[" ( number | name operator literal ) "]"
+ *	operator  := "=" | "!=" | "<" | "<=" | ">" | ">="
+ *	name      := word | number | string
+ *	literal   := word | number | string
+ *
+ * A word is a run of anything but spaces and the punctuation above, and
+ * a string is in double or single quotes, with \ escaping a quote or \.
+ * A * selects elements of any name, and a ~"regex" those whose whole
+ * name the regular expression matches, so ~"user_?[iI][dD]" finds userId,
+ * user_id and userID. A quoted "*" is just a name.
+ *
+ * A . is the element a step is at, and .. the one it's in, so
+ * /order/item[name="pen"]/../price is the price of the order with a pen.
+ * The axes that go back, ancestor and preceding-sibling, count positions
+ * back from where they start, nearest first, so ancestor::*[1] is the
+ * parent. An axis can't follow a //, which is already descendant.
+ *
+ * A comparison such as [price>100] selects elements with any child price
+ * whose text value is more than 100. How values are compared, as numbers
+ * or as strings, is in compare.go. Predicates are taken in turn, each on
+ * what the one before it left, so [price>100][2] is the second of those
+ * over 100, and [2][price>100] the second, if it's over 100.
+ */
+
+// Axis is the direction a step searches in from the one before it
+type Axis int
+
+const (
+	Child      Axis = iota // after a /
+	Descendant             // after a //
+	Self                   // a .
+	Parent                 // a ..
+	Ancestor
+	FollowingSibling
+	PrecedingSibling
+)
+
+// the axes by name, as in following-sibling::
+var axes = map[string]Axis{
+	"child":             Child,
+	"descendant":        Descendant,
+	"self":              Self,
+	"parent":            Parent,
+	"ancestor":          Ancestor,
+	"following-sibling": FollowingSibling,
+	"preceding-sibling": PrecedingSibling,
+}
+
+func (a Axis) String() string {
+	for name, axis := range axes {
+		if axis == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// LocationPath is a parsed path expression
+type LocationPath struct {
+	Absolute bool // starts with a / or //
+	Steps    []*Step
+}
+
+// Step is one component of a path, such as galaxy[2]
+type Step struct {
+	Pos        int // where it starts in the expression, from 0
+	Axis       Axis
+	Name       string         // for * or ~"regex", the * or the regex
+	Pattern    *regexp.Regexp // for * or ~"regex", what names it matches
+	Parse      bool           // a parse() step, which re-lexes what it's given
+	Format     string         // for parse(), "json", "xml" or "" to guess
+	Predicates []Predicate
+}
+
+// Predicate is a selection expression within a step's []s
+type Predicate interface {
+	String() string
+	Offset() int // where it starts in the expression, from 0
+}
+
+// Position selects the nth of the elements a step names, from 1
+type Position struct {
+	Pos int
+	N   int
+}
+
+// Comparison selects the elements with a child Name whose text value
+// compares to Value by Op
+type Comparison struct {
+	Pos   int
+	Name  string
+	Op    string // =, !=, <, <=, > or >=
+	Value string
+}
+
+// SyntaxError reports a path expression that doesn't parse, and where
+type SyntaxError struct {
+	Expression string
+	Pos        int // from 0
+	Msg        string
+}
+
+// Error quotes the expression with a caret under the offending column,
+// counting characters, not bytes
+func (e *SyntaxError) Error() string {
+	col := column(e.Expression, e.Pos)
+	return fmt.Sprintf("syntax error at column %d of path expression, %s\n\t%s\n\t%s^",
+		col, e.Msg, e.Expression, strings.Repeat(" ", col-1))
+}
+
+// column returns the column, from 1, of the character at pos, a byte
+// offset into the expression
+func column(expression string, pos int) int {
+	if pos > len(expression) {
+		pos = len(expression)
+	}
+	return utf8.RuneCountInString(expression[:pos]) + 1
+}
+
+// ParseExpr parses a path expression into a tree of its steps
+func ParseExpr(expression string) (*LocationPath, error) {
+	var ps = parser{expression: expression}
+
+	if err := ps.scan(); err != nil {
+		return nil, err
+	}
+	return ps.path()
+}
+
+/*
+ * The tokenizer
+ */
+
+// the kinds of item in an expression
+const (
+	itemEOF = iota
+	itemSlash
+	itemSlashSlash
+	itemLeftBracket
+	itemRightBracket
+	itemLeftParen
+	itemRightParen
+	itemCompare
+	itemTilde
+	itemColonColon
+	itemWord
+	itemNumber
+	itemString
+)
+
+// item is a token of a path expression. Its text is unquoted, if it's
+// a string.
+type item struct {
+	kind int
+	text string
+	pos  int
+}
+
+// punctuation ends a word
+const punctuation = `/[]()="'!<>~`
+
+// the items of a single character
+var single = map[rune]int{
+	'/': itemSlash,
+	'[': itemLeftBracket,
+	']': itemRightBracket,
+	'(': itemLeftParen,
+	')': itemRightParen,
+	'=': itemCompare,
+	'<': itemCompare,
+	'>': itemCompare,
+	'~': itemTilde,
+}
+
+// what items are called in errors
+var itemNames = map[int]string{
+	itemEOF:          "end of expression",
+	itemSlash:        `"/"`,
+	itemSlashSlash:   `"//"`,
+	itemLeftBracket:  `"["`,
+	itemRightBracket: `"]"`,
+	itemLeftParen:    `"("`,
+	itemRightParen:   `")"`,
+	itemCompare:      "a comparison such as \"=\"",
+	itemTilde:        `"~"`,
+	itemColonColon:   `"::"`,
+	itemWord:         "a name",
+	itemNumber:       "a number",
+	itemString:       "a quoted string",
+}
+
+// describe names an item for an error message
+func (it item) describe() string {
+	switch it.kind {
+	case itemWord, itemNumber:
+		return strconv.Quote(it.text)
+	case itemString:
+		return "the string " + strconv.Quote(it.text)
+	}
+	return itemNames[it.kind]
+}
+
+// parser holds an expression, its items and how far it has got
+type parser struct {
+	expression string
+	items      []item
+	next       int
+}
+
+// scan splits the expression into items
+func (ps *parser) scan() error {
+	var s = ps.expression
+
+	for i := 0; i < len(s); {
+		r, width := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += width
+			continue
+		case strings.HasPrefix(s[i:], "//"):
+			ps.items = append(ps.items, item{itemSlashSlash, "//", i})
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], "!="), strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], ">="):
+			ps.items = append(ps.items, item{itemCompare, s[i : i+2], i})
+			i += 2
+			continue
+		case strings.HasPrefix(s[i:], "::"):
+			ps.items = append(ps.items, item{itemColonColon, "::", i})
+			i += 2
+			continue
+		case r == '"' || r == '\'':
+			text, n, err := ps.quoted(i)
+			if err != nil {
+				return err
+			}
+			ps.items = append(ps.items, item{itemString, text, i})
+			i += n
+			continue
+		}
+		if kind, ok := single[r]; ok {
+			ps.items = append(ps.items, item{kind, string(r), i})
+			i += width
+			continue
+		}
+		if strings.ContainsRune(punctuation, r) {
+			return ps.errorf(i, "unexpected %q", r)
+		}
+
+		// a word, which is a number if it's all digits
+		start := i
+		for i < len(s) {
+			r, width = utf8.DecodeRuneInString(s[i:])
+			if unicode.IsSpace(r) || strings.ContainsRune(punctuation, r) ||
+				strings.HasPrefix(s[i:], "::") {
+				break
+			}
+			i += width
+		}
+		kind := itemNumber
+		for _, r := range s[start:i] {
+			if !unicode.IsDigit(r) {
+				kind = itemWord
+				break
+			}
+		}
+		ps.items = append(ps.items, item{kind, s[start:i], start})
+	}
+	ps.items = append(ps.items, item{itemEOF, "", len(s)})
+	return nil
+}
+
+// quoted takes the string starting with the quote at i, returning its
+// text and its length including the quotes
+func (ps *parser) quoted(i int) (string, int, error) {
+	var s = ps.expression
+	var text []byte
+	var quote = s[i]
+
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case quote:
+			return string(text), j + 1 - i, nil
+		case '\\':
+			if j+1 < len(s) && (s[j+1] == quote || s[j+1] == '\\') {
+				j++
+			}
+		}
+		text = append(text, s[j])
+	}
+	return "", 0, ps.errorf(i, "the string is never closed")
+}
+
+/*
+ * The parser, one method per rule of the grammar
+ */
+
+// path parses a whole expression
+func (ps *parser) path() (*LocationPath, error) {
+	var lp LocationPath
+	var axis = Child
+
+	switch ps.peek().kind {
+	case itemSlash:
+		lp.Absolute = true
+		ps.take()
+	case itemSlashSlash:
+		lp.Absolute = true
+		axis = Descendant
+		ps.take()
+	case itemEOF:
+		return nil, ps.errorf(0, "the expression is empty")
+	}
+
+	for ps.peek().kind != itemEOF {
+		st, err := ps.step(axis)
+		if err != nil {
+			return nil, err
+		}
+		lp.Steps = append(lp.Steps, st)
+
+		switch it := ps.take(); it.kind {
+		case itemEOF:
+			return &lp, nil
+		case itemSlash:
+			axis = Child
+		case itemSlashSlash:
+			axis = Descendant
+			if ps.peek().kind == itemEOF {
+				return nil, ps.errorf(ps.peek().pos, "expected a name after \"//\"")
+			}
+		default:
+			return nil, ps.errorf(it.pos, "expected \"/\" or the end, not %s", it.describe())
+		}
+	}
+	if axis == Descendant && len(lp.Steps) == 0 {
+		return nil, ps.errorf(ps.peek().pos, "expected a name after \"//\"")
+	}
+	return &lp, nil
+}
+
+// step parses an axis and name test, or parse(), . or .., and any
+// predicates
+func (ps *parser) step(axis Axis) (*Step, error) {
+	var it = ps.take()
+	var st = &Step{Pos: it.pos, Axis: axis, Name: it.text}
+	var named bool // has an axis::
+
+	if it.kind == itemWord && ps.peek().kind == itemColonColon {
+		a, ok := axes[it.text]
+		if !ok {
+			return nil, ps.errorf(it.pos, "%q isn't an axis", it.text)
+		}
+		if axis == Descendant {
+			return nil, ps.errorf(it.pos, "an axis can't follow \"//\"")
+		}
+		ps.take()
+		st.Axis, named = a, true
+		it = ps.take()
+		st.Name = it.text
+	}
+
+	switch it.kind {
+	case itemWord, itemNumber, itemString:
+		switch {
+		case it.kind != itemWord:
+		case it.text == "*":
+			st.Pattern = AnyName
+		case (it.text == "." || it.text == "..") && !named:
+			if axis == Descendant {
+				return nil, ps.errorf(it.pos, "%s can't follow \"//\"", it.text)
+			}
+			st.Axis, st.Pattern = Self, anyNode
+			if it.text == ".." {
+				st.Axis = Parent
+			}
+			if ps.peek().kind == itemLeftBracket {
+				return nil, ps.errorf(ps.peek().pos, "%s can't have a predicate", it.text)
+			}
+			return st, nil
+		}
+	case itemTilde:
+		re := ps.take()
+		if re.kind != itemString {
+			return nil, ps.errorf(re.pos, "expected a quoted regular expression after \"~\", not %s",
+				re.describe())
+		}
+		if _, err := regexp.Compile(re.text); err != nil {
+			return nil, ps.errorf(re.pos, "%v", err)
+		}
+		// it has to match the whole name, not just some of it
+		st.Name, st.Pattern = re.text, regexp.MustCompile(`^(?:`+re.text+`)$`)
+	default:
+		return nil, ps.errorf(it.pos, "expected a name, not %s", it.describe())
+	}
+
+	if it.kind == itemWord && it.text == "parse" && ps.peek().kind == itemLeftParen && !named {
+		ps.take()
+		st.Parse = true
+		if f := ps.peek(); f.kind == itemWord {
+			if f.text != "json" && f.text != "xml" {
+				return nil, ps.errorf(f.pos, "parse() takes json or xml, not %q", f.text)
+			}
+			st.Format = f.text
+			ps.take()
+		}
+		if err := ps.expect(itemRightParen); err != nil {
+			return nil, err
+		}
+		if ps.peek().kind == itemLeftBracket {
+			return nil, ps.errorf(ps.peek().pos, "parse() can't have a predicate")
+		}
+		return st, nil
+	}
+
+	for ps.peek().kind == itemLeftBracket {
+		pr, err := ps.predicate()
+		if err != nil {
+			return nil, err
+		}
+		st.Predicates = append(st.Predicates, pr)
+	}
+	return st, nil
+}
+
+// predicate parses a [n], or a [name=value] or other comparison
+func (ps *parser) predicate() (Predicate, error) {
+	var pr Predicate
+	var open = ps.take()
+
+	it := ps.take()
+	switch {
+	case it.kind == itemNumber && ps.peek().kind == itemRightBracket:
+		n, err := strconv.Atoi(it.text)
+		if err != nil || n < 1 {
+			return nil, ps.errorf(it.pos, "a position counts from 1, so %s can't be one", it.text)
+		}
+		pr = &Position{Pos: open.pos, N: n}
+
+	case it.kind == itemWord || it.kind == itemNumber || it.kind == itemString:
+		op := ps.take()
+		if op.kind != itemCompare {
+			return nil, ps.errorf(op.pos, "expected %s, not %s", itemNames[itemCompare], op.describe())
+		}
+		value := ps.take()
+		if value.kind != itemWord && value.kind != itemNumber && value.kind != itemString {
+			return nil, ps.errorf(value.pos, "expected a value to compare to, not %s", value.describe())
+		}
+		pr = &Comparison{Pos: open.pos, Name: it.text, Op: op.text, Value: value.text}
+
+	default:
+		return nil, ps.errorf(it.pos, "expected a position or a comparison such as name=value, not %s", it.describe())
+	}
+	if err := ps.expect(itemRightBracket); err != nil {
+		return nil, err
+	}
+	return pr, nil
+}
+
+// peek returns the next item without taking it
+func (ps *parser) peek() item {
+	return ps.items[ps.next]
+}
+
+// take returns the next item, and stays at the end once there
+func (ps *parser) take() item {
+	it := ps.items[ps.next]
+	if it.kind != itemEOF {
+		ps.next++
+	}
+	return it
+}
+
+// expect takes an item of the kind given, or reports what it found
+func (ps *parser) expect(kind int) error {
+	if it := ps.take(); it.kind != kind {
+		return ps.errorf(it.pos, "expected %s, not %s", itemNames[kind], it.describe())
+	}
+	return nil
+}
+
+// errorf makes a syntax error at a position in the expression
+func (ps *parser) errorf(pos int, format string, v ...interface{}) error {
+	return &SyntaxError{Expression: ps.expression, Pos: pos, Msg: fmt.Sprintf(format, v...)}
+}
+
+/*
+ * Printing the tree, which gives back a tidied expression
+ */
+
+// String returns the path in the path language
+func (lp *LocationPath) String() string {
+	var s string
+
+	for i, st := range lp.Steps {
+		if i > 0 || lp.Absolute {
+			s += "/"
+		}
+		if st.Axis == Descendant {
+			s += "/"
+		}
+		s += st.String()
+	}
+	if s == "" && lp.Absolute {
+		return "/"
+	}
+	return s
+}
+
+// String returns the step, without the slash before it
+func (st *Step) String() string {
+	if st.Parse {
+		return "parse(" + st.Format + ")"
+	}
+	var s string
+	switch {
+	case st.Pattern == anyNode && st.Axis == Self:
+		return "."
+	case st.Pattern == anyNode && st.Axis == Parent:
+		return ".."
+	}
+	if st.Axis != Child && st.Axis != Descendant {
+		s = st.Axis.String() + "::"
+	}
+	switch {
+	case st.Pattern == AnyName:
+		s += "*"
+	case st.Pattern != nil:
+		s += "~" + quote(st.Name)
+	default:
+		s += quoteName(st.Name)
+	}
+	for _, pr := range st.Predicates {
+		s += pr.String()
+	}
+	return s
+}
+
+// String returns the position in []s
+func (pr *Position) String() string {
+	return "[" + strconv.Itoa(pr.N) + "]"
+}
+
+// Offset returns where the predicate starts
+func (pr *Position) Offset() int {
+	return pr.Pos
+}
+
+// String returns the comparison in []s, with the value quoted
+func (pr *Comparison) String() string {
+	return "[" + quoteName(pr.Name) + pr.Op + quote(pr.Value) + "]"
+}
+
+// Offset returns where the predicate starts
+func (pr *Comparison) Offset() int {
+	return pr.Pos
+}
+
+// quoteName quotes a name only if it wouldn't scan as a word, or would
+// be taken for a wildcard, a . or .., or an axis
+func quoteName(name string) string {
+	switch {
+	case name == "", name == "*", name == ".", name == "..", strings.Contains(name, "::"):
+	case strings.IndexFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || strings.ContainsRune(punctuation, r)
+	}) >= 0:
+	default:
+		return name
+	}
+	return quote(name)
+}
+
+// quote puts a string in double quotes, as the tokenizer reads them, so
+// only a quote or a backslash is escaped
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -7,10 +7,12 @@ package pathExpr
 import (
 	"trace"
 	"token"
+	xml_lexer "xml"
+	json_lexer "json"
 
-	"fmt"
+	encoding_json "encoding/json"
+	"html"
 	"strings"
-	"os"
 	//"io/ioutil"
 )
 
@@ -21,12 +23,14 @@ import (
 // Path is a set of tokens to traverse
 type Path []token.Token
 
-var warnings = 0  // Serially reusable, courtesy of this.
-//var errors = 0  / future
 
-// NewPath creates a new path from a slice of Tokens
-func NewPath(input []token.Token, trace trace.Trace) Path {
-	t = trace
+// untraced is the trace the exported primitives use: evaluations trace
+// with their own, so nothing is shared between goroutines
+var untraced = trace.New(nil, false)
+
+// NewPath creates a new path from a slice of Tokens. It doesn't keep the
+// trace, as each evaluation has its own.
+func NewPath(input []token.Token, t trace.Trace) Path {
 	defer t.Begin()()
 	return input
 }
@@ -34,6 +38,11 @@ func NewPath(input []token.Token, trace trace.Trace) Path {
 // TextValue returns the text value within a bounded path. Do not use on a
 // path with lots of values, you'll get all the texts
 func (p Path) TextValue() string {
+	return p.textValue(untraced)
+}
+
+// textValue is TextValue, traced
+func (p Path) textValue(t trace.Trace) string {
 	var s string
 
 	defer t.Begin(p)()
@@ -42,33 +51,30 @@ func (p Path) TextValue() string {
 			s += strings.TrimSpace(t.Val) + " "
 			// FIXME this could throw false positives due to <TEXT "\n"> tokens
 			// the parser goroutine needs to squeeze them out
-			//if i > 0 {
-			//	fmt.Fprintf(os.Stderr, "TextValue: warning, more than one " +
-			//		"text value in the specified path. The result may be " +
-			//		"legitimately multiple, but it can also be wrong due " +
-			//		"to an error in the input, %v\n", p)
-			//	warnings++
-			//}
 		}
 	}
-	s = strings.TrimSpace(s)
-	if (len(s) == 0 ) {
-		fmt.Fprintf(os.Stderr, "TextValue: warning, did not find " +
-			"non-blank text in the specified path. The result may be " +
-			"legitimately blank, but it can also be wrong due " +
-			"to an error in the input, %v\n", p)
-		warnings++
-	}
-	return s
+	return strings.TrimSpace(s)
 }
 
-// Warnings returns the number of warnings made
-func (p Path) Warnings() int {
-	return warnings
+// texts counts the non-blank text values within a path
+func (p Path) texts() int {
+	var n int
+
+	for _, t := range p {
+		if t.Typ == token.VALUE && strings.TrimSpace(t.Val) != "" {
+			n++
+		}
+	}
+	return n
 }
 
 // FindFirst finds the first instance of a sub-path within the global path.
 func (p Path) FindFirst(target string) Path {
+	return p.findFirst(target, untraced)
+}
+
+// findFirst is FindFirst, traced
+func (p Path) findFirst(target string, t trace.Trace) Path {
 
 	defer t.Begin(target)()
 	var beginning int
@@ -88,7 +94,9 @@ func (p Path) FindFirst(target string) Path {
 			}
 			t.Printf("end is p[%d]=%s\n",
 				i, p[i:i+1])
-			return p[beginning:i]
+			// with room to grow to the end of p, for FindNext, but
+			// not past it, out of the element p is in
+			return p[beginning:i:len(p)]
 		}
 	}
 	// no end, return nil
@@ -96,8 +104,14 @@ func (p Path) FindFirst(target string) Path {
 }
 
 
-// FindNext finds the next element after the end of the previous one
+// FindNext finds the next element after the end of the previous one,
+// within the element they're both in
 func (p Path) FindNext(target string) Path {
+	return p.findNext(target, untraced)
+}
+
+// findNext is FindNext, traced
+func (p Path) findNext(target string, t trace.Trace) Path {
 	var q Path
 
 	defer t.Begin(target)()
@@ -108,51 +122,82 @@ func (p Path) FindNext(target string) Path {
 		q = nil
 	}
 
-	return q.FindFirst(target)
+	return q.findFirst(target, t)
 }
 
 // FindSuchThat loops through elements, looking for tokenName == desiredValue and
-// then return a subslice containing all of the matching elements.
+// then return a subslice containing all of the matching elements. It
+// returns nil if there's none, which could be legit.
 func (p Path) FindSuchThat(element, tokenName, desiredValue string) Path {
 	var q = p
 
-	defer t.Begin(element, tokenName, desiredValue)()
-	t.Printf("input=%s\n", p)
-
 	// advance to the beginning of the first galaxy, at BEGIN element
 	// search through the galaxies for tokenName == desiredValue
 	for q = q.FindFirst(element); q != nil ; q = q.FindNext(element) {
-		t.Printf("q=%s\n", q)
-
 		subPath := q.FindFirst(tokenName)
-		t.Printf("subpath=%s\n", subPath)
 		if subPath.TextValue() == desiredValue {
 			// return the beginning of the subpath q if we matched
 			return q
 		}
 	}
-	// didn't find it at all, which could be legit
-	fmt.Fprintf(os.Stderr, "FindSuchThat: warning, did not find " +
-		"a %s such that %s=%q. It may legitimately not exist, but " +
-		"it can also be wrong due to an error in the input, %v\n",
-		element, tokenName, desiredValue, p)
-	warnings++
 	return nil
 }
 
-// FindNth loops through n copies of element
+// FindNth finds the nth child element named element, counting from 1,
+// so the nth galaxy of a universe is never in some other universe
 func (p Path) FindNth(element string, n int) Path {
-    	var q = p
+	return p.first(p.find(Child, named(element), &Position{N: n}, untraced))
+}
 
-	defer t.Begin(element, n)()
-	i := 1 // for the findFirst
-	for q = q.FindFirst(element); i < n && q != nil ; q = q.FindNext(element) {
-		i++
-	}
-	return q
+// Parse re-lexes the text within a path as a document of its own, for
+// json or xml that has been embedded, escaped, in a string value. The
+// format is "json", "xml", or "" to guess from the first character. It
+// returns nil if there's no text to parse.
+func (p Path) Parse(format string) Path {
+	return p.parse(format, untraced)
 }
 
+// parse is Parse, traced
+func (p Path) parse(format string, t trace.Trace) Path {
+	var s string
 
+	defer t.Begin(format)()
+	for _, tok := range p {
+		if tok.Typ == token.VALUE {
+			s += tok.Val
+		}
+	}
+	s = strings.TrimSpace(unescape(s))
+	if s == "" {
+		return nil
+	}
+	if format == "" {
+		format = "json"
+		if strings.HasPrefix(s, "<") {
+			format = "xml"
+		}
+	}
+	t.Printf("parsing %.40q as %s\n", s, format)
+	if format == "xml" {
+		return xml_lexer.Lex(s, t)
+	}
+	return json_lexer.Lex(s, t)
+}
+
+// unescape undoes the escaping a document gets when embedded in a
+// value: backslashes from a json string, entities from xml text.
+func unescape(s string) string {
+	if strings.Contains(s, `\`) {
+		var unquoted string
+		if encoding_json.Unmarshal([]byte(`"` + s + `"`), &unquoted) == nil {
+			s = unquoted
+		}
+	}
+	if strings.Contains(s, "&") {
+		s = html.UnescapeString(s)
+	}
+	return s
+}
 
 /*
  * for doc.go:
@@ -0,0 +1,459 @@
+package pathExpr
+
+import (
+	"token"
+	"trace"
+
+	"sort"
+)
+
+/*
+ * Evaluating expressions as their input is read. The steps at the start
+ * of a path that go down, to children or descendants, and whose
+ * predicates are positions, are taken as each BEGIN arrives, as that's
+ * all they need to know. The last of them, the anchor, may compare too,
+ * so the elements it may select are kept from their BEGIN to their END,
+ * when it can be decided, and the steps after it are done on what was
+ * kept, as Eval does them. Only those elements are held, not the document.
+ *
+ * Once no element that's still open can hold anything more the steps
+ * select, the rest of the input isn't read. An xml document has one
+ * outermost element, so /universe/galaxy[1]/world is over once the first
+ * galaxy has ended. A json document can repeat a name at its top level,
+ * as an array's elements do, so there that's only known of the elements
+ * within it. A path that goes up or sideways from its start, or to an
+ * ancestor anywhere, has no anchor: the whole document is kept, and the
+ * steps are done on it once it's all been read.
+ */
+
+// Stream evaluates a path expression against tokens as they arrive from
+// a lexer's pipe, rather than against a whole document, as StreamAll
+// does for a single expression
+func Stream(pipe <-chan token.Token, expression string, stop func(), found func(Node) bool, tp trace.Trace) (*Result, error) {
+	e, err := Compile(expression)
+	if err != nil {
+		stop()
+		return &Result{}, err
+	}
+	return e.Stream(pipe, stop, found, tp)
+}
+
+// Stream evaluates a compiled expression as its input arrives, as the
+// function Stream does
+func (e *Expr) Stream(pipe <-chan token.Token, stop func(), found func(Node) bool, tp trace.Trace) (*Result, error) {
+	var each func(int, Node) bool
+
+	if found != nil {
+		each = func(_ int, n Node) bool { return found(n) }
+	}
+	results, errs := StreamAll([]*Expr{e}, pipe, stop, each, tp)
+	return results[0], errs[0]
+}
+
+// StreamAll evaluates expressions against tokens as they arrive from a
+// lexer's pipe. Each node an expression selects is passed to found, if
+// it isn't nil, with the expression's index, as soon as it's been read
+// to its end, in document order. If found returns false, no more are
+// wanted from that expression. Once no expression can select any more,
+// stop is called to end the lexer, and the rest of the input isn't
+// read. The results and errors are Eval's, by expression, for the nodes
+// that were passed on. An AmbiguousError is only returned if the other
+// choices were read by then.
+func StreamAll(exprs []*Expr, pipe <-chan token.Token, stop func(), found func(int, Node) bool, tp trace.Trace) ([]*Result, []error) {
+	var streamers []*streamer
+
+	defer tp.Begin(exprs)()
+	for i, e := range exprs {
+		s := newStreamer(e, tp)
+		if found != nil {
+			i := i
+			s.found = func(n Node) bool { return found(i, n) }
+		}
+		streamers = append(streamers, s)
+	}
+	for tok := range pipe {
+		if tok.Typ == token.EOF || tok.Typ == token.ERROR {
+			break
+		}
+		var live int
+		for _, s := range streamers {
+			if !s.done {
+				s.feed(tok)
+			}
+			if !s.done {
+				live++
+			}
+		}
+		if live == 0 {
+			tp.Printf("nothing more can be selected, stopping\n")
+			break
+		}
+	}
+	stop()
+
+	var results = make([]*Result, len(exprs))
+	var errs = make([]error, len(exprs))
+	for i, s := range streamers {
+		results[i], errs[i] = s.finish()
+	}
+	return results, errs
+}
+
+// streamer is the evaluation of one expression as its input arrives
+type streamer struct {
+	e         *Expr
+	t         trace.Trace
+	anchor    int      // the last step taken as the input arrives, or -1
+	root      *frame   // the document
+	open      []*frame // the elements being read, innermost last
+	kept      Path     // the element being kept, while it's read
+	outer     *frame   // which it is
+	anchors   []span   // what the anchor selected in it
+	reached   []bool   // whether each step up to the anchor selected anything
+	missing   *NotFoundError // the furthest step after it that didn't
+	ambiguous error
+	nodes     []Node   // what's been selected
+	found     func(Node) bool
+	done      bool     // nothing more is wanted, or can be selected
+}
+
+// frame is an element being read, or the document
+type frame struct {
+	parent    *frame // the named element it's in, or the document
+	named     bool
+	begin     int    // where its BEGIN is in what's kept, if it's kept
+	sel       []bool // sel[k] is whether step k-1 selected it, so step k looks from it
+	within    []bool // within[k] is whether it or an element it's in has sel[k]
+	counts    map[[2]int]int // how many children passed each step's predicates
+	selected  int    // how many the anchor selected from it
+	candidate bool   // the anchor may select it, once it's read
+	single    bool   // it's the document, and its one outermost element has begun
+}
+
+// newStreamer starts evaluating an expression as its input arrives
+func newStreamer(e *Expr, t trace.Trace) *streamer {
+	var s = streamer{e: e, t: t, anchor: anchor(e.path.Steps)}
+
+	s.root = &frame{named: true, begin: -1, sel: make([]bool, s.anchor+2)}
+	s.root.sel[0] = true
+	s.root.within = s.root.sel
+	s.reached = make([]bool, s.anchor+1)
+	if s.anchor < 0 {
+		// the whole document is kept
+		s.kept = Path{}
+	}
+	t.Printf("%s is anchored at step %d\n", e, s.anchor)
+	return &s
+}
+
+// anchor returns the last of the steps that can be taken as the input
+// arrives, or -1 if there's none. They go down, and only the last of
+// them can compare, at an element's END. The steps after it may go up
+// or sideways, but not out of what it selects.
+func anchor(steps []*Step) int {
+	var j = len(steps) - 1
+
+	lower := func(k int) {
+		if k < j {
+			j = k
+		}
+	}
+	for k, st := range steps {
+		if st.Parse {
+			// which needs the whole of what's before it, and selects a
+			// document of its own, which the steps after it can't leave
+			lower(k - 1)
+			break
+		}
+		switch st.Axis {
+		case Child, Descendant:
+		case Self:
+			lower(k - 1)
+		case Parent, FollowingSibling, PrecedingSibling:
+			// they stay within what the step before last selected, if
+			// the step before went down from it
+			if k == 0 || steps[k-1].Axis != Child && steps[k-1].Axis != Descendant {
+				return -1
+			}
+			lower(k - 2)
+		default:
+			return -1
+		}
+		for _, pr := range st.Predicates {
+			if _, ok := pr.(*Comparison); ok {
+				lower(k)
+			}
+		}
+	}
+	return j
+}
+
+// feed takes the next token of the input
+func (s *streamer) feed(tok token.Token) {
+	if s.anchor < 0 {
+		s.kept = append(s.kept, tok)
+		return
+	}
+	switch tok.Typ {
+	case token.BEGIN:
+		f := s.begin(tok.Val)
+		if s.kept == nil && f.candidate {
+			s.kept, s.outer = Path{}, f
+		}
+		if s.kept != nil {
+			s.kept = append(s.kept, tok)
+			f.begin = len(s.kept) - 1
+		}
+	case token.END:
+		if s.kept != nil {
+			s.kept = append(s.kept, tok)
+		}
+		s.end(len(s.kept) - 1)
+	default:
+		if s.kept != nil {
+			s.kept = append(s.kept, tok)
+		}
+		return
+	}
+	if !s.live() {
+		s.done = true
+	}
+}
+
+// begin takes a BEGIN, doing the steps up to the anchor that select it
+func (s *streamer) begin(name string) *frame {
+	var parent = s.root
+	var f = frame{named: name != "", begin: -1}
+
+	for i := len(s.open) - 1; i >= 0; i-- {
+		if s.open[i].named {
+			parent = s.open[i]
+			break
+		}
+	}
+	if len(s.open) == 0 && f.named {
+		s.root.single = true
+	}
+	s.open = append(s.open, &f)
+	if !f.named {
+		// transparent, so its children are its parent's
+		return &f
+	}
+	f.parent = parent
+	f.sel = make([]bool, s.anchor+2)
+	f.within = append([]bool(nil), parent.within...)
+	for k := 0; k <= s.anchor; k++ {
+		if !s.selects(parent, k, name) {
+			continue
+		}
+		if k == s.anchor {
+			f.candidate = true
+			continue
+		}
+		f.sel[k+1], f.within[k+1], s.reached[k] = true, true, true
+	}
+	return &f
+}
+
+// selects reports whether step k selects an element called name that's
+// in parent, as far as its BEGIN tells, counting it towards the step's
+// positions up to its first comparison
+func (s *streamer) selects(parent *frame, k int, name string) bool {
+	st := s.e.path.Steps[k]
+	if !st.test().matches(name) || st.Axis == Child && !parent.sel[k] ||
+		st.Axis == Descendant && !parent.within[k] {
+		return false
+	}
+	for i, pr := range st.Predicates {
+		pos, ok := pr.(*Position)
+		if !ok {
+			// the rest wait for its END
+			break
+		}
+		if parent.count(k, i) != pos.N {
+			return false
+		}
+	}
+	return true
+}
+
+// count counts one more child of f that's passed step k's predicates
+// before the i'th, returning how many there have been
+func (f *frame) count(k, i int) int {
+	if f.counts == nil {
+		f.counts = make(map[[2]int]int)
+	}
+	f.counts[[2]int{k, i}]++
+	return f.counts[[2]int{k, i}]
+}
+
+// end takes the END of the innermost element being read, which is at
+// in what's kept, deciding whether the anchor selects it
+func (s *streamer) end(at int) {
+	if len(s.open) == 0 {
+		// a stray END
+		return
+	}
+	f := s.open[len(s.open)-1]
+	s.open = s.open[:len(s.open)-1]
+	if f.candidate {
+		s.decide(f, at)
+	}
+	if f == s.outer {
+		s.flush()
+	}
+}
+
+// decide takes the anchor's predicates from its first comparison on, on
+// an element that's been read to its end, and records it if it passes
+func (s *streamer) decide(f *frame, end int) {
+	var st = s.e.path.Steps[s.anchor]
+	var compared bool
+
+	contents := s.kept[f.begin+1 : end]
+	for i, pr := range st.Predicates {
+		switch pr := pr.(type) {
+		case *Comparison:
+			compared = true
+			if !contents.satisfies(pr, s.t) {
+				return
+			}
+		case *Position:
+			if compared && f.parent.count(s.anchor, i) != pr.N {
+				return
+			}
+		}
+	}
+	s.reached[s.anchor] = true
+	s.anchors = append(s.anchors, span{begin: f.begin, end: end})
+	if pr, ok := predicate(st).(*Comparison); ok && pr.Op == "=" {
+		// more than one from the same element is ambiguous, as in Eval
+		for c := f.parent; c != nil && (st.Axis == Descendant || c == f.parent); c = c.parent {
+			if c.sel[s.anchor] {
+				if c.selected++; c.selected > 1 {
+					s.ambiguous = &AmbiguousError{Expression: s.e.expression, Step: st.String(), Pos: st.Pos}
+				}
+			}
+		}
+	}
+}
+
+// flush does the steps after the anchor on what it selected in the
+// element that's been kept, and passes on what they select
+func (s *streamer) flush() {
+	var from []node
+
+	kept, anchors := s.kept, s.anchors
+	s.kept, s.outer, s.anchors = nil, nil, nil
+	if len(anchors) == 0 {
+		return
+	}
+	// those within others were decided first
+	sort.Slice(anchors, func(i, j int) bool { return anchors[i].begin < anchors[j].begin })
+	for _, sp := range anchors {
+		from = append(from, node{0, sp})
+	}
+	ev := evaluation{expression: s.e.expression, t: s.t, docs: []Path{kept}}
+	nodes, err := ev.steps(from, s.e.path.Steps[s.anchor+1:])
+	if nodes == nil {
+		if nf, ok := err.(*NotFoundError); ok && (s.missing == nil || nf.Pos > s.missing.Pos) {
+			s.missing = nf
+		}
+		return
+	}
+	if err != nil {
+		s.ambiguous = err
+	}
+	for _, n := range ev.result(nodes, nil).Nodes {
+		s.nodes = append(s.nodes, n)
+		if s.found != nil && !s.found(n) {
+			s.t.Printf("no more are wanted, stopping\n")
+			s.done = true
+			return
+		}
+	}
+}
+
+// live reports whether anything more can be selected: from what's being
+// kept, or from what's yet to be read in the document or an element a
+// step up to the anchor looks from
+func (s *streamer) live() bool {
+	if s.kept != nil || s.looks(s.root) {
+		return true
+	}
+	for _, f := range s.open {
+		if f.named && s.looks(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// looks reports whether a step up to the anchor can select something in
+// f that's yet to be read
+func (s *streamer) looks(f *frame) bool {
+	for k, st := range s.e.path.Steps[:s.anchor+1] {
+		switch {
+		case st.Axis == Descendant && f.within[k]:
+			return true
+		case st.Axis == Child && f.sel[k] && !s.exhausted(f, k):
+			return true
+		}
+	}
+	return false
+}
+
+// exhausted reports whether f has had all the children step k can
+// select: as many as one of its positions, or for the document, its one
+// outermost element
+func (s *streamer) exhausted(f *frame, k int) bool {
+	if f.single {
+		return true
+	}
+	for i, pr := range s.e.path.Steps[k].Predicates {
+		if pos, ok := pr.(*Position); ok && f.counts[[2]int{k, i}] >= pos.N {
+			return true
+		}
+	}
+	return false
+}
+
+// finish returns what was selected, once the input has ended or no more
+// is wanted. Elements still open when the input ended are taken as
+// ending there, as Eval takes them.
+func (s *streamer) finish() (*Result, error) {
+	var last *Step
+
+	if n := len(s.e.path.Steps); n > 0 {
+		last = s.e.path.Steps[n-1]
+	}
+	if s.anchor < 0 {
+		r, err := s.e.run(s.kept, s.t)
+		if r == nil {
+			return &Result{}, err
+		}
+		for i, n := range r.Nodes {
+			if s.found != nil && !s.found(n) {
+				r.Nodes = r.Nodes[:i+1]
+				break
+			}
+		}
+		return r, err
+	}
+	for !s.done && len(s.open) > 0 {
+		s.end(len(s.kept))
+	}
+	if len(s.nodes) == 0 {
+		for k, ok := range s.reached {
+			if !ok {
+				st := s.e.path.Steps[k]
+				return &Result{}, &NotFoundError{Expression: s.e.expression, Step: st.String(), Pos: st.Pos}
+			}
+		}
+		if s.missing != nil {
+			return &Result{}, s.missing
+		}
+		return &Result{}, nil
+	}
+	return &Result{Nodes: s.nodes, Value: s.nodes[0].Value, Warnings: warnings(s.nodes, last)}, s.ambiguous
+}
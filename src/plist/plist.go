@@ -0,0 +1,108 @@
+// Package plist -- decoder for Apple xml property lists, on top of the xml
+// lexer. It rewrites <dict>'s alternating <key> and value elements into the
+// tokens the json lexer would produce for the equivalent json, so each key
+// becomes a BEGIN/END pair with the key's name and arrays index like json
+// arrays. As with json, a value's type isn't kept: <string>3</string> and
+// <integer>3</integer> are both 3, and a <date> is its text.
+package plist
+
+import (
+	"lexer"
+	"token"
+	"trace"
+	xml_lexer "xml"
+
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Lex is the entry point to the plist decoder
+func Lex(input string, tp trace.Trace) []token.Token {
+	return LexContext(context.Background(), input, tp)
+}
+
+// LexContext decodes until done or until ctx is cancelled, when the
+// tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) []token.Token {
+	defer tp.Begin()()
+	root, err := xml_lexer.Tree(xml_lexer.LexContext(ctx, input, tp))
+	var v lexer.Tree
+	if err == nil {
+		v, err = document(root)
+	}
+	if err != nil {
+		return []token.Token{{Typ: token.ERROR, Val: err.Error()}}
+	}
+	return lexer.LexTree(ctx, v, tp)
+}
+
+// document decodes the one value within <plist>
+func document(root *xml_lexer.Node) (lexer.Tree, error) {
+	if root.Name != "plist" {
+		return lexer.Tree{}, fmt.Errorf("not a property list, <%s>", root.Name)
+	}
+	for _, v := range root.Children {
+		if v.Name != "version" {
+			// which is an attribute of <plist>
+			return value(v)
+		}
+	}
+	return lexer.Tree{}, fmt.Errorf("empty property list")
+}
+
+// value decodes a value element
+func value(v *xml_lexer.Node) (lexer.Tree, error) {
+	switch v.Name {
+	case "dict":
+		return entries(v)
+	case "array":
+		var t = lexer.Tree{Item: lexer.Item{Kind: lexer.Array}}
+		for _, c := range v.Children {
+			e, err := value(c)
+			if err != nil {
+				return t, err
+			}
+			t.Values = append(t.Values, e)
+		}
+		return t, nil
+	}
+	s, err := scalar(v)
+	return lexer.Tree{Item: lexer.Item{Kind: lexer.Scalar, Text: s}}, err
+}
+
+// entries decodes the <key>, value pairs of a <dict>
+func entries(dict *xml_lexer.Node) (lexer.Tree, error) {
+	var t = lexer.Tree{Item: lexer.Item{Kind: lexer.Mapping}}
+
+	children := dict.Children
+	for i := 0; i < len(children); i += 2 {
+		if children[i].Name != "key" || i+1 >= len(children) {
+			return t, fmt.Errorf("dict has <%s> where a <key> and value were expected",
+				children[i].Name)
+		}
+		v, err := value(children[i+1])
+		if err != nil {
+			return t, err
+		}
+		t.Keys = append(t.Keys, children[i].Text)
+		t.Values = append(t.Values, v)
+	}
+	return t, nil
+}
+
+// scalar returns the text of a scalar value, as the equivalent json
+// literal: <true/> and <false/> become true and false
+func scalar(n *xml_lexer.Node) (string, error) {
+	switch n.Name {
+	case "string":
+		return n.Text, nil
+	case "integer", "real", "date":
+		return strings.TrimSpace(n.Text), nil
+	case "true", "false":
+		return n.Name, nil
+	case "data":
+		return strings.Join(strings.Fields(n.Text), ""), nil
+	}
+	return "", fmt.Errorf("unknown property list type <%s>", n.Name)
+}
@@ -0,0 +1,275 @@
+// Package soap -- unwraps SOAP envelopes, on top of the xml lexer. It returns
+// the tokens within the Body, so path expressions are relative to the payload,
+// and reports SOAP 1.1 and 1.2 faults as errors.
+package soap
+
+import (
+	"token"
+	"trace"
+	xml_lexer "xml"
+
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// the namespaces of the two versions of the envelope
+const (
+	namespace11 = "http://schemas.xmlsoap.org/soap/envelope/"
+	namespace12 = "http://www.w3.org/2003/05/soap-envelope"
+)
+
+// Fault is a SOAP fault, which services return as a successful response
+type Fault struct {
+	Version string // "1.1" or "1.2"
+	Code    string // faultcode, or Code/Value in 1.2
+	String  string // faultstring, or Reason/Text in 1.2
+	Actor   string // faultactor, or Role in 1.2
+	Detail  string // the text of the detail, if any
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("SOAP %s fault, faultcode=%q, faultstring=%q", f.Version, f.Code, f.String)
+}
+
+// IsSoap reports whether the input looks like a SOAP envelope
+func IsSoap(input string) bool {
+	return strings.Contains(input, namespace11) || strings.Contains(input, namespace12)
+}
+
+// Lex is the entry point to the soap decoder. It returns the tokens of
+// the Body's contents, without namespace prefixes or xmlns attributes,
+// and a *Fault if the Body holds a fault.
+func Lex(input string, tp trace.Trace) ([]token.Token, error) {
+	return LexContext(context.Background(), input, tp)
+}
+
+// LexContext is Lex, stopping with an error if ctx is cancelled
+func LexContext(ctx context.Context, input string, tp trace.Trace) ([]token.Token, error) {
+	defer tp.Begin()()
+
+	tokens := xml_lexer.LexContext(ctx, input, tp)
+
+	// find the Body, within the Envelope
+	var i, depth int
+	for i = 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok.Typ == token.ERROR {
+			return nil, fmt.Errorf("%s", tok.Val)
+		}
+		if tok.Typ == token.BEGIN {
+			depth++
+			if depth == 1 && localName(tok.Val) != "Envelope" {
+				return nil, fmt.Errorf("not a SOAP envelope, <%s>", tok.Val)
+			}
+			if depth == 2 && localName(tok.Val) == "Body" {
+				break
+			}
+		} else if tok.Typ == token.END {
+			depth--
+		}
+	}
+	if i == len(tokens) {
+		return nil, fmt.Errorf("SOAP envelope has no Body")
+	}
+
+	// skip its attributes, such as soap:encodingStyle, which the lexer
+	// makes into elements before its children
+	body := i + 1
+	for n := attributes(input); n > 0 && body < len(tokens); n-- {
+		body = end(tokens, body) + 1
+	}
+	payload := unwrap(tokens[body:])
+	tp.Printf("payload=%s\n", payload)
+
+	// and see if one of its children is a fault
+	depth = 0
+	for j := body; j < len(tokens) && depth >= 0; j++ {
+		switch tokens[j].Typ {
+		case token.BEGIN:
+			if depth == 0 {
+				if f := faultAt(tokens, j, tp); f != nil {
+					return payload, f
+				}
+			}
+			depth++
+		case token.END:
+			depth--
+		}
+	}
+	return payload, nil
+}
+
+// faultAt returns the fault that begins at i, or nil if the element
+// there isn't a Fault in either version's namespace
+func faultAt(tokens []token.Token, i int, tp trace.Trace) *Fault {
+	if localName(tokens[i].Val) != "Fault" {
+		return nil
+	}
+	k := end(tokens, i)
+	ns := namespaces(tokens[:k+1])[prefix(tokens[i].Val)]
+	if ns != namespace11 && ns != namespace12 {
+		tp.Printf("<%s> is in %q, not a SOAP fault\n", tokens[i].Val, ns)
+		return nil
+	}
+	root, err := xml_lexer.Tree(unwrap(tokens[i : k+1]))
+	if err != nil {
+		return nil
+	}
+	if ns == namespace12 {
+		return fault(root, "1.2")
+	}
+	return fault(root, "1.1")
+}
+
+// attributes counts the attributes of the Envelope's Body, as the lexer
+// doesn't tell them from children. The start tags are parsed by
+// encoding/xml, so a Body in a comment or CDATA, or an = in a quoted
+// value, is what it is.
+func attributes(input string) int {
+	var depth int
+
+	d := xml.NewDecoder(strings.NewReader(input))
+	d.Strict = false
+	for {
+		tok, err := d.RawToken()
+		if err != nil {
+			return 0
+		}
+		switch el := tok.(type) {
+		case xml.StartElement:
+			if depth++; depth == 2 && el.Name.Local == "Body" {
+				return len(el.Attr)
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// end returns where the element that begins at i ends
+func end(tokens []token.Token, i int) int {
+	var depth int
+
+	for ; i < len(tokens); i++ {
+		switch tokens[i].Typ {
+		case token.BEGIN:
+			depth++
+		case token.END:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+// namespaces returns the namespaces the xmlns attributes in tokens bind
+// to each prefix, with the default namespace's prefix "". Where a prefix
+// is bound more than once, the last binding is taken.
+func namespaces(tokens []token.Token) map[string]string {
+	var bound = make(map[string]string)
+
+	for i := 0; i+1 < len(tokens); i++ {
+		name := tokens[i].Val
+		if tokens[i].Typ != token.BEGIN || tokens[i+1].Typ != token.VALUE ||
+			(name != "xmlns" && !strings.HasPrefix(name, "xmlns:")) {
+			continue
+		}
+		bound[strings.TrimPrefix(strings.TrimPrefix(name, "xmlns"), ":")] = tokens[i+1].Val
+	}
+	return bound
+}
+
+// unwrap copies the tokens up to the end of the Body, dropping xmlns
+// attributes and the namespace prefixes of names
+func unwrap(tokens []token.Token) []token.Token {
+	var payload []token.Token
+	var depth, skipping int
+
+	for _, tok := range tokens {
+		switch tok.Typ {
+		case token.BEGIN:
+			depth++
+			if skipping == 0 && strings.HasPrefix(tok.Val, "xmlns") {
+				skipping = depth
+			}
+		case token.END:
+			depth--
+			if depth < 0 {
+				// the end of the Body
+				return append(payload, token.Token{Typ: token.EOF, Val: ""})
+			}
+			if skipping > depth {
+				skipping = 0
+				continue
+			}
+		}
+		if skipping == 0 {
+			if tok.Typ != token.VALUE {
+				tok.Val = localName(tok.Val)
+			}
+			payload = append(payload, tok)
+		}
+	}
+	return payload
+}
+
+// fault reads a Fault element, in either version's layout
+func fault(n *xml_lexer.Node, version string) *Fault {
+	var f = Fault{Version: version}
+
+	if n.Child("Code") != nil {
+		// SOAP 1.2 nests its code and reason
+		f.Version = "1.2"
+		f.Code = value(n.Child("Code").Child("Value"))
+		if reason := n.Child("Reason"); reason != nil {
+			f.String = value(reason.Child("Text"))
+		}
+		f.Actor = value(n.Child("Role"))
+		f.Detail = text(n.Child("Detail"))
+		return &f
+	}
+	f.Code = value(n.Child("faultcode"))
+	f.String = value(n.Child("faultstring"))
+	f.Actor = value(n.Child("faultactor"))
+	f.Detail = text(n.Child("detail"))
+	return &f
+}
+
+// value returns the text directly within an element, if there is one
+func value(n *xml_lexer.Node) string {
+	if n == nil {
+		return ""
+	}
+	return strings.TrimSpace(n.Text)
+}
+
+// text returns the text within an element and all the elements in it
+func text(n *xml_lexer.Node) string {
+	if n == nil {
+		return ""
+	}
+	s := strings.TrimSpace(n.Text)
+	for _, c := range n.Children {
+		if t := text(c); t != "" {
+			s = strings.TrimSpace(s + " " + t)
+		}
+	}
+	return s
+}
+
+// localName drops the namespace prefix of a name, as in soap:Body
+func localName(name string) string {
+	return name[strings.LastIndex(name, ":")+1:]
+}
+
+// prefix returns the namespace prefix of a name, soap in soap:Body, or
+// "" if it has none
+func prefix(name string) string {
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+// Package unpack -- reads the members of zip and tar archives in memory,
+// so each can be lexed as a document of its own without extracting them.
+package unpack
+
+import (
+	"trace"
+
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// MaxMember is the most a member may hold once it's decompressed, so a
+// small archive can't inflate to fill memory
+var MaxMember int64 = 64 << 20
+
+// Member is a file within an archive
+type Member struct {
+	Name string // the member's path within the archive
+	Data string
+}
+
+// Type recognizes an archive by its magic number, returning "zip",
+// "tar" or "" if it isn't one
+func Type(input string) string {
+	if strings.HasPrefix(input, "PK\x03\x04") || strings.HasPrefix(input, "PK\x05\x06") {
+		return "zip"
+	}
+	if len(input) > 262 && input[257:262] == "ustar" {
+		return "tar"
+	}
+	return ""
+}
+
+// Members returns the regular files in a zip or tar archive, in the
+// order they're stored. If glob isn't empty, only members whose path or
+// base name match it are returned.
+func Members(input, glob string, tp trace.Trace) ([]Member, error) {
+	defer tp.Begin(glob)()
+
+	if _, err := path.Match(glob, ""); err != nil {
+		return nil, fmt.Errorf("bad member pattern %q, %v", glob, err)
+	}
+	switch Type(input) {
+	case "zip":
+		return zipMembers(input, glob, tp)
+	case "tar":
+		return tarMembers(input, glob, tp)
+	}
+	return nil, fmt.Errorf("not a zip or tar archive")
+}
+
+// zipMembers reads the members of a zip archive
+func zipMembers(input, glob string, tp trace.Trace) ([]Member, error) {
+	var members []Member
+
+	r, err := zip.NewReader(strings.NewReader(input), int64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !matches(glob, f.Name) {
+			tp.Printf("skipping %s\n", f.Name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name, err)
+		}
+		data, err := read(f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Member{Name: f.Name, Data: data})
+	}
+	return members, nil
+}
+
+// tarMembers reads the members of a tar archive
+func tarMembers(input, glob string, tp trace.Trace) ([]Member, error) {
+	var members []Member
+
+	r := tar.NewReader(strings.NewReader(input))
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return members, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg || !matches(glob, hdr.Name) {
+			tp.Printf("skipping %s\n", hdr.Name)
+			continue
+		}
+		data, err := read(hdr.Name, r)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Member{Name: hdr.Name, Data: data})
+	}
+}
+
+// read reads a member, but no more than MaxMember of it, reporting one
+// that's bigger as an error
+func read(name string, r io.Reader) (string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxMember+1))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	if int64(len(data)) > MaxMember {
+		return "", fmt.Errorf("%s: bigger than the limit of %d bytes", name, MaxMember)
+	}
+	return string(data), nil
+}
+
+// matches reports whether a member's path, or its base name, matches glob
+func matches(glob, name string) bool {
+	if glob == "" {
+		return true
+	}
+	if ok, _ := path.Match(glob, name); ok {
+		return true
+	}
+	ok, _ := path.Match(glob, path.Base(name))
+	return ok
+}
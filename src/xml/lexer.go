@@ -8,6 +8,9 @@ import (
 	"lexer"
 	"trace"
 
+	"context"
+	"fmt"
+	"io"
 	"strings"
 	"unicode"
 )
@@ -16,41 +19,26 @@ import (
 
 // stateFn represents the state of the scanner
 // as a function that returns the Next state.
-type stateFn func(*lexer.Lexer) stateFn
+type stateFn = lexer.StateFn
 
 var eof = -1
 
 // Lex -- the entry point to the xml lexer
 func Lex(Input string, tp trace.Trace) ([]token.Token) {
-	Input = strings.TrimSpace(Input)
-	l := lexer.New(Input, make(chan token.Token), tp)
-	
-	defer l.Begin()()
-
-	go run(l) // Run the lexer, closes pipe
-
-	// Simulate a parser, return only when done
-	var slice []token.Token
-	var tok token.Token
+	return LexContext(context.Background(), Input, tp)
+}
 
-	for tok = range l.Pipe {
-		//tok = <- l.Pipe
-		slice = append(slice, tok)
-		if tok.Typ == token.EOF {
-			break
-		}
-	}
-	return slice
+// LexContext is Lex until ctx is cancelled or its deadline passes, when
+// the tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) ([]token.Token) {
+	return lexer.Lex(ctx, input, lexStart, tp)
 }
 
-// Run lexes the Input by executing state functions until
-// the state is nil.
-func  run(l * lexer.Lexer) {
-	defer l.Begin(l)()
-	for state := lexTag; state != nil; {
-		state = state(l)
-	}
-	close(l.Pipe)
+// Start starts lexing xml as it's read, returning the running lexer, so
+// only the tokens need be kept in memory, not the document. Its Tokens
+// are LexContext's.
+func Start(ctx context.Context, r io.Reader, tp trace.Trace) *lexer.Lexer {
+	return lexer.Start(ctx, r, lexStart, tp)
 }
 
 
@@ -58,7 +46,7 @@ func  run(l * lexer.Lexer) {
 func lexTag(l *lexer.Lexer) stateFn {
 	var tokenTypeFound token.Type
 	var ch int
-	var s string
+	var s, name string
 
 	defer l.Begin()()
 	// Process the first character
@@ -70,8 +58,14 @@ func lexTag(l *lexer.Lexer) stateFn {
 	}
 
 	// We have a <, do we have an </ or not?
-	l.Printf("right now, start is at %.40q ...\n", l.Rest())
+	l.Printf("right now, start is at %q ...\n", l.Ahead(40))
 	l.Ignore()
+	if l.HasPrefix("![CDATA[") {
+		return lexCdata
+	}
+	if l.HasPrefix("!") || l.HasPrefix("?") {
+		return lexDeclaration
+	}
 	tokenTypeFound = token.BEGIN // Subject to change, though
 	ch = l.Next()
 	if ch == '/' {
@@ -92,11 +86,14 @@ func lexTag(l *lexer.Lexer) stateFn {
 			// Then we hit /> or a grammar error
 			l.Backup()
 			if len(l.Current()) > 0 {
-				l.Emit(tokenTypeFound, l.Current())
+				name = l.Current()
+				l.Emit(tokenTypeFound, name)
+			}
+			if name != "" {
 				// emit an empty value
 				l.Emit(token.VALUE, "")
 				// and then end the type
-				l.Emit(token.END, l.Current())
+				l.Emit(token.END, name)
 			}
 			l.Next()
 			l.Next()
@@ -122,7 +119,8 @@ func lexTag(l *lexer.Lexer) stateFn {
 		if unicode.IsSpace(rune(ch)) {
 			// Emit the begin or end here
 			l.Backup()
-			l.Emit(tokenTypeFound, l.Current())
+			name = l.Current()
+			l.Emit(tokenTypeFound, name)
 			l.Ignore()
 			lexAttributes(l)
 		}
@@ -143,6 +141,66 @@ func lexTag(l *lexer.Lexer) stateFn {
 	return nil
 }
 
+// lexDeclaration skips over an xml declaration, processing instruction,
+// doctype or comment, none of which we have a use for
+func lexDeclaration(l *lexer.Lexer) stateFn {
+	var end = ">"
+
+	defer l.Begin()()
+	if l.HasPrefix("!--") {
+		end = "-->"
+	} else if l.HasPrefix("!DOCTYPE") {
+		// look for an internal subset, which has declarations of its own
+		for ch := l.Next(); ch != '>'; ch = l.Next() {
+			if ch == eof {
+				l.Emit(token.EOF, "")
+				return nil
+			}
+			if ch == '[' {
+				end = "]>"
+				break
+			}
+		}
+		if end == ">" {
+			l.Ignore()
+			return lexText
+		}
+	}
+	for !l.HasPrefix(end) {
+		if l.Next() == eof {
+			l.Emit(token.EOF, "")
+			return nil
+		}
+	}
+	for range end {
+		l.Next()
+	}
+	l.Ignore()
+	return lexText
+}
+
+// lexCdata lexes a CDATA section as a VALUE
+func lexCdata(l *lexer.Lexer) stateFn {
+	defer l.Begin()()
+	for range "![CDATA[" {
+		l.Next()
+	}
+	l.Ignore()
+	for !l.HasPrefix("]]>") {
+		if l.Next() == eof {
+			l.Emit(token.VALUE, l.Current())
+			l.Emit(token.EOF, "")
+			return nil
+		}
+	}
+	l.Emit(token.VALUE, l.Current())
+	for range "]]>" {
+		l.Next()
+	}
+	l.Ignore()
+	return lexText
+}
+
 // lexAttributes starts a subloop getting name=value pairs until >
 func lexAttributes(l *lexer.Lexer) {
 	defer l.Begin()()
@@ -209,12 +267,13 @@ func lexText(l *lexer.Lexer) stateFn {
 	var ch int
 
 	defer l.Begin()()
-	l.Printf("Input=%.40q ...\n", l.Rest())
-	if l.Rest() == "" {
+	l.Printf("Input=%q ...\n", l.Ahead(40))
+	if l.Next() == eof {
 		l.Print("Emitting EOF, returning nil\n")
 		l.Emit(token.EOF, "")
 		return nil      // Stop the run loop.
 	}
+	l.Backup()
 	for {
 		ch = l.Next()
 		if ch == '<' {
@@ -231,12 +290,71 @@ func lexText(l *lexer.Lexer) stateFn {
 			break
 		}
 	}
-	s:= l.Current()
+	// trailing whitespace isn't part of the document
+	s:= strings.TrimRightFunc(l.Current(), unicode.IsSpace)
 	if len(s) > 0 {
 		l.Print("Emitting output\n")
-		l.Emit(token.VALUE, l.Current())
+		l.Emit(token.VALUE, s)
 	}
 	l.Emit(token.EOF, "")
 	return nil
 }
 
+// lexStart skips leading whitespace, which isn't part of the document
+func lexStart(l *lexer.Lexer) stateFn {
+	defer l.Begin()()
+	for unicode.IsSpace(rune(l.Next())) {
+	}
+	l.Backup()
+	l.Ignore()
+	return lexTag
+}
+
+
+// Node is an element and its contents, for decoders that rewrite
+// xml-based formats into tokens of their own
+type Node struct {
+	Name     string
+	Text     string  // the text directly within the element
+	Children []*Node // elements, and attributes, within it
+}
+
+// Tree builds the tokens from Lex into a tree, and returns the outermost
+// element. Text outside of it, such as whitespace, is dropped.
+func Tree(tokens []token.Token) (*Node, error) {
+	var root = &Node{}
+	var stack = []*Node{root}
+
+	for _, tok := range tokens {
+		current := stack[len(stack)-1]
+		switch tok.Typ {
+		case token.BEGIN:
+			n := &Node{Name: tok.Val}
+			current.Children = append(current.Children, n)
+			stack = append(stack, n)
+		case token.VALUE:
+			current.Text += tok.Val
+		case token.END:
+			if len(stack) == 1 {
+				return nil, fmt.Errorf("unbalanced </%s>", tok.Val)
+			}
+			stack = stack[:len(stack)-1]
+		case token.ERROR:
+			return nil, fmt.Errorf("%s", tok.Val)
+		}
+	}
+	if len(root.Children) == 0 {
+		return nil, fmt.Errorf("no elements found")
+	}
+	return root.Children[0], nil
+}
+
+// Child returns the first element within n with the given name, or nil
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Package xmlrpc -- decoder for XML-RPC, on top of the xml lexer. It rewrites
+// the generic <struct>, <member>, <name> and <value> elements into the tokens
+// the json lexer would produce for the equivalent json, so a member becomes
+// a BEGIN/END pair with the member's name and arrays index like json arrays.
+// The <params>, <param> and <value> wrappers are dropped, so the value of a
+// single-parameter response is the whole document. As with json, a value's
+// type isn't kept: <string>3</string> and <int>3</int> are both 3.
+package xmlrpc
+
+import (
+	"lexer"
+	"token"
+	"trace"
+	xml_lexer "xml"
+
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Lex is the entry point to the xml-rpc decoder
+func Lex(input string, tp trace.Trace) []token.Token {
+	return LexContext(context.Background(), input, tp)
+}
+
+// LexContext decodes until done or until ctx is cancelled, when the
+// tokens end with an ERROR saying so
+func LexContext(ctx context.Context, input string, tp trace.Trace) []token.Token {
+	defer tp.Begin()()
+	root, err := xml_lexer.Tree(xml_lexer.LexContext(ctx, input, tp))
+	var v lexer.Tree
+	if err == nil {
+		v, err = document(root)
+	}
+	if err != nil {
+		return []token.Token{{Typ: token.ERROR, Val: err.Error()}}
+	}
+	return lexer.LexTree(ctx, v, tp)
+}
+
+// document rewrites a methodResponse or a methodCall. A fault becomes
+// an element named fault, and a call's parameters an array named params.
+func document(root *xml_lexer.Node) (lexer.Tree, error) {
+	var call = lexer.Tree{Item: lexer.Item{Kind: lexer.Mapping}}
+
+	switch root.Name {
+	case "methodResponse":
+		if fault := root.Child("fault"); fault != nil {
+			v, err := value("fault", fault.Child("value"))
+			call.Keys, call.Values = []string{"fault"}, []lexer.Tree{v}
+			return call, err
+		}
+		values, err := list("param", params(root))
+		if len(values) == 1 {
+			return values[0], err
+		}
+		return lexer.Tree{Item: lexer.Item{Kind: lexer.Array}, Values: values}, err
+
+	case "methodCall":
+		// a call with no name has an empty one
+		var name = lexer.Tree{Item: lexer.Item{Kind: lexer.Mapping}}
+		if n := root.Child("methodName"); n != nil {
+			name = lexer.Tree{Item: lexer.Item{Kind: lexer.Scalar, Text: strings.TrimSpace(n.Text)}}
+		}
+		call.Keys, call.Values = []string{"methodName"}, []lexer.Tree{name}
+		values, err := list("param", params(root))
+		if len(values) > 0 {
+			call.Keys = append(call.Keys, "params")
+			call.Values = append(call.Values, lexer.Tree{Item: lexer.Item{Kind: lexer.Array}, Values: values})
+		}
+		return call, err
+	}
+	return lexer.Tree{}, fmt.Errorf("not an xml-rpc methodResponse or methodCall, <%s>", root.Name)
+}
+
+// params returns the values of each <param> in <params>
+func params(root *xml_lexer.Node) []*xml_lexer.Node {
+	var values []*xml_lexer.Node
+
+	if p := root.Child("params"); p != nil {
+		for _, param := range p.Children {
+			if v := param.Child("value"); param.Name == "param" && v != nil {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// value decodes a <value>, which is the value of name
+func value(name string, v *xml_lexer.Node) (lexer.Tree, error) {
+	if v == nil {
+		return lexer.Tree{}, fmt.Errorf("%s has no <value>", name)
+	}
+	typed := typeOf(v)
+	switch typed.Name {
+	case "struct":
+		return members(typed)
+	case "array":
+		values, err := list(name, arrayValues(typed))
+		return lexer.Tree{Item: lexer.Item{Kind: lexer.Array}, Values: values}, err
+	}
+	s, err := scalar(typed)
+	return lexer.Tree{Item: lexer.Item{Kind: lexer.Scalar, Text: s}}, err
+}
+
+// list decodes the <value>s of an array or of the params, all of name
+func list(name string, vs []*xml_lexer.Node) ([]lexer.Tree, error) {
+	var values []lexer.Tree
+
+	for _, v := range vs {
+		t, err := value(name, v)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, t)
+	}
+	return values, nil
+}
+
+// members decodes each <member> of a <struct> as an entry named by its <name>
+func members(s *xml_lexer.Node) (lexer.Tree, error) {
+	var t = lexer.Tree{Item: lexer.Item{Kind: lexer.Mapping}}
+
+	for _, m := range s.Children {
+		if m.Name != "member" {
+			continue
+		}
+		name := m.Child("name")
+		if name == nil {
+			return t, fmt.Errorf("struct member has no <name>")
+		}
+		v, err := value(strings.TrimSpace(name.Text), m.Child("value"))
+		if err != nil {
+			return t, err
+		}
+		t.Keys = append(t.Keys, strings.TrimSpace(name.Text))
+		t.Values = append(t.Values, v)
+	}
+	return t, nil
+}
+
+// arrayValues returns the values in an <array>'s <data>
+func arrayValues(a *xml_lexer.Node) []*xml_lexer.Node {
+	var values []*xml_lexer.Node
+
+	if data := a.Child("data"); data != nil {
+		for _, v := range data.Children {
+			if v.Name == "value" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// typeOf returns the element within a <value> that gives its type. A
+// <value> with only text in it is a string, and is returned itself.
+func typeOf(v *xml_lexer.Node) *xml_lexer.Node {
+	if len(v.Children) == 0 {
+		return v
+	}
+	return v.Children[0]
+}
+
+// scalar returns the text of a scalar value, as the equivalent json
+// literal: booleans become true or false and nil becomes null
+func scalar(n *xml_lexer.Node) (string, error) {
+	switch n.Name {
+	case "value", "string":
+		return n.Text, nil
+	case "int", "i4", "i8", "double", "dateTime.iso8601":
+		return strings.TrimSpace(n.Text), nil
+	case "boolean":
+		switch strings.TrimSpace(n.Text) {
+		case "1":
+			return "true", nil
+		case "0":
+			return "false", nil
+		}
+		return "", fmt.Errorf("bad boolean %q", n.Text)
+	case "base64":
+		return strings.Join(strings.Fields(n.Text), ""), nil
+	case "nil":
+		return "null", nil
+	}
+	return "", fmt.Errorf("unknown xml-rpc type <%s>", n.Name)
+}